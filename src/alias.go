@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// fieldAliases map alternative names of request fields to the names
+// RCPushNotification uses, top level fields in "" and options fields in
+// "options". encoding/json matches names case-insensitively, so spellings
+// like notID or userID need no alias.
+var fieldAliases = map[string]map[string]string{
+	"": {
+		"deviceToken": "token",
+	},
+	"options": {
+		"notificationId": "notId",
+		"body":           "text",
+	},
+}
+
+// UnmarshalJSON decodes the request like decode, accepting unknown fields
+func (n *RCPushNotification) UnmarshalJSON(data []byte) error {
+	return n.decode(data, false)
+}
+
+// decode decodes the request, accepting the aliases of fieldAliases for
+// fields that are missing under their own name. With strict unknown fields
+// are rejected, which a custom UnmarshalJSON can't learn from the decoder.
+func (n *RCPushNotification) decode(data []byte, strict bool) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	aliases, changed := resolveAliases(fields, fieldAliases[""])
+	if raw, ok := fields["options"]; ok {
+		var options map[string]json.RawMessage
+		if json.Unmarshal(raw, &options) == nil {
+			matched, optionsChanged := resolveAliases(options, fieldAliases["options"])
+			for _, alias := range matched {
+				aliases = append(aliases, "options."+alias)
+			}
+			if optionsChanged {
+				fields["options"], _ = json.Marshal(options)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		data, _ = json.Marshal(fields)
+	}
+
+	// the plain type has no UnmarshalJSON, which would recurse
+	type plain RCPushNotification
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode((*plain)(n)); err != nil {
+		return err
+	}
+	n.aliases = aliases
+	return nil
+}
+
+// resolveAliases renames the aliases in fields to their names, unless the
+// name is present itself in any case. It returns the renamed aliases and whether fields
+// changed.
+func resolveAliases(fields map[string]json.RawMessage, aliases map[string]string) ([]string, bool) {
+	var matched []string
+	changed := false
+	for alias, name := range aliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if !hasField(fields, name) {
+			fields[name] = value
+			matched = append(matched, alias)
+		}
+		delete(fields, alias)
+		changed = true
+	}
+	return matched, changed
+}
+
+// hasField reports whether fields contains name, case-insensitively like
+// encoding/json
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for k := range fields {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
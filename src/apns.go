@@ -1,97 +1,625 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-func getAPNPushNotificationHandler() func(http.ResponseWriter, *rcRequest) {
-	cert, err := certificate.FromP12File(
-		os.Getenv("RCPG_APNS_CERT_FILE"),
-		os.Getenv("RCPG_APNS_CERT_PASS"),
-	)
+// apnsTokenLength is the length of a hex encoded APNs device token
+const apnsTokenLength = 64
+
+// isValidToken checks that token looks like an APNs device token, so
+// malformed ones can be rejected without a round trip to Apple
+func (c *APNSConfig) isValidToken(token string) bool {
+	if c.SkipTokenCheck {
+		return true
+	}
+	if len(token) != apnsTokenLength {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// parseInvalidTokenReasons returns the APNs rejection reasons that make
+// Rocket.Chat delete the device token, RCPG_APNS_INVALID_TOKEN_REASONS
+// replaces the defaults with a comma separated list
+func parseInvalidTokenReasons(list []string) map[string]bool {
+	reasons := map[string]bool{}
+	for _, reason := range list {
+		reasons[reason] = true
+	}
+	if len(reasons) == 0 {
+		reasons[apns2.ReasonBadDeviceToken] = true
+		reasons[apns2.ReasonDeviceTokenNotForTopic] = true
+		reasons[apns2.ReasonUnregistered] = true
+	}
+	return reasons
+}
+
+// countRejection counts an APNs rejection other than an invalid token in the
+// bucket of its reason, so systemic problems like an expired certificate stand
+// out in the stats
+func (s *status) countRejection(res *apns2.Response) {
+	switch res.Reason {
+	case apns2.ReasonBadCertificate, apns2.ReasonBadCertificateEnvironment,
+		apns2.ReasonForbidden, apns2.ReasonExpiredProviderToken,
+		apns2.ReasonInvalidProviderToken, apns2.ReasonMissingProviderToken,
+		apns2.ReasonMissingTopic, apns2.ReasonBadTopic, apns2.ReasonTopicDisallowed:
+		s.apnsAuthErrors.Add(1)
+	case apns2.ReasonTooManyRequests, apns2.ReasonTooManyProviderTokenUpdates:
+		s.apnsRateErrors.Add(1)
+	case apns2.ReasonInternalServerError, apns2.ReasonServiceUnavailable,
+		apns2.ReasonShutdown, apns2.ReasonIdleTimeout:
+		s.apnsServerErrors.Add(1)
+	default:
+		switch {
+		case res.StatusCode == http.StatusForbidden:
+			s.apnsAuthErrors.Add(1)
+		case res.StatusCode == http.StatusTooManyRequests:
+			s.apnsRateErrors.Add(1)
+		case res.StatusCode >= 500:
+			s.apnsServerErrors.Add(1)
+		default:
+			s.apnsPayloadErrors.Add(1)
+		}
+	}
+}
+
+func parseInterruptionLevel(s string) (payload.EInterruptionLevel, error) {
+	switch level := payload.EInterruptionLevel(strings.TrimSpace(s)); level {
+	case payload.InterruptionLevelPassive,
+		payload.InterruptionLevelActive,
+		payload.InterruptionLevelTimeSensitive:
+		return level, nil
+	}
+	return "", fmt.Errorf("invalid interruption level: %q", s)
+}
+
+// parseInterruptionLevels parses the default interruption level of
+// RCPG_APNS_INTERRUPTION_LEVEL, and the per room type levels of the comma
+// separated type=level list of RCPG_APNS_INTERRUPTION_LEVELS
+func parseInterruptionLevels(def, list string) (payload.EInterruptionLevel, map[string]payload.EInterruptionLevel, error) {
+	var defLevel payload.EInterruptionLevel
+	if def != "" {
+		level, err := parseInterruptionLevel(def)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid RCPG_APNS_INTERRUPTION_LEVEL: %w", err)
+		}
+		defLevel = level
+	}
+	levels := map[string]payload.EInterruptionLevel{}
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		roomType, s, ok := strings.Cut(entry, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid RCPG_APNS_INTERRUPTION_LEVELS entry: %q", entry)
+		}
+		level, err := parseInterruptionLevel(s)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid RCPG_APNS_INTERRUPTION_LEVELS: %w", err)
+		}
+		levels[strings.TrimSpace(roomType)] = level
+	}
+	return defLevel, levels, nil
+}
+
+// interruptionLevel returns the interruption-level for the room type of the
+// notification
+func (c *APNSConfig) interruptionLevel(pl *RCPayload) payload.EInterruptionLevel {
+	if pl != nil {
+		if level, ok := c.InterruptionLevels[pl.Type]; ok {
+			return level
+		}
+	}
+	return c.InterruptionLevel
+}
+
+// getSubtitle returns the room name as subtitle for rooms other than direct
+// messages, unless it's already the title
+func getSubtitle(title string, pl *RCPayload) string {
+	if pl == nil || pl.Type == "d" || pl.Name == title {
+		return ""
+	}
+	return pl.Name
+}
+
+// The localization keys of the alerts with RCPG_APNS_LOC_KEYS. The app has to
+// define them in its Localizable.strings, see README.md.
+const (
+	locKeyTitle      = "PUSH_TITLE"
+	locKeyRoomTitle  = "PUSH_ROOM_TITLE"
+	locKeyMessage    = "PUSH_MESSAGE"
+	locKeyNewMessage = "PUSH_NEW_MESSAGE"
+)
+
+// alertSetter sets the title and body of the alert
+type alertSetter func(p *payload.Payload, title, body string)
+
+func setLiteralAlert(p *payload.Payload, title, body string) {
+	p.AlertTitle(title).AlertBody(body)
+}
+
+// locAlert returns the alertSetter for the localization keys of the
+// notification, and false if it isn't a message. The room name is part of
+// the title, so no subtitle is needed.
+func locAlert(pl *RCPayload) (alertSetter, bool) {
+	if pl == nil || pl.NotificationType != "message" && pl.NotificationType != "message-id-only" {
+		return nil, false
+	}
+	sender := senderName(pl)
+	return func(p *payload.Payload, title, body string) {
+		switch {
+		case pl.Type != "d" && pl.Name != "" && sender != "":
+			p.AlertTitleLocKey(locKeyRoomTitle).AlertTitleLocArgs([]string{sender, pl.Name})
+		case title != "":
+			p.AlertTitleLocKey(locKeyTitle).AlertTitleLocArgs([]string{title})
+		}
+		// the app fetches the content of message-id-only notifications
+		if pl.NotificationType == "message-id-only" {
+			p.AlertLocKey(locKeyNewMessage)
+		} else {
+			p.AlertLocKey(locKeyMessage).AlertLocArgs([]string{body})
+		}
+	}, true
+}
+
+// setCriticalSound turns the notification into a critical alert
+func setCriticalSound(p *payload.Payload, sound string, volume float32) {
+	if sound == "" {
+		sound = "default"
+	}
+	if volume <= 0 || volume > 1 {
+		volume = 1
+	}
+	p.SoundName(sound).
+		SoundVolume(volume).
+		InterruptionLevel(payload.InterruptionLevelCritical)
+}
+
+// messageIDOnlyExpiration caps the expiration of message-id-only
+// notifications, so stale ones don't wake up devices late
+const messageIDOnlyExpiration = 5 * time.Minute
+
+// expiration returns the value for apns-expiration, where the unix epoch
+// means "deliver immediately or discard"
+func (c *APNSConfig) expiration(messageIDOnly bool) time.Time {
+	d := c.Expiration
+	if messageIDOnly && (d < 0 || d > messageIDOnlyExpiration) {
+		d = messageIDOnlyExpiration
+	}
+	switch {
+	case d < 0:
+		return time.Time{}
+	case d == 0:
+		return time.Unix(0, 0)
+	}
+	return time.Now().Add(d)
+}
+
+// parseAPNSHeaders reads the apns-expiration and apns-priority headers of
+// the request, malformed values are ignored. The priority of background
+// notifications is always 5.
+func (r *rcRequest) parseAPNSHeaders() {
+	if s := r.http.Header.Get("apns-expiration"); s != "" {
+		if secs, err := strconv.ParseInt(s, 10, 64); err == nil && secs >= 0 {
+			t := time.Unix(secs, 0)
+			r.apnsExpiration = &t
+		} else {
+			r.Debugf("Ignoring malformed apns-expiration header: %q", s)
+		}
+	}
+	if s := r.http.Header.Get("apns-priority"); s != "" {
+		switch p, _ := strconv.Atoi(s); p {
+		case 1, apns2.PriorityLow, apns2.PriorityHigh:
+			r.apnsPriority = p
+		default:
+			r.Debugf("Ignoring malformed apns-priority header: %q", s)
+		}
+	}
+}
+
+// apnsMaxCollapseID is the maximum length of apns-collapse-id in bytes
+const apnsMaxCollapseID = 64
+
+// collapseID returns the apns-collapse-id for a notification, so that
+// multiple pushes for the same message replace each other on the device, like
+// the CollapseKey does for FCM. The raw message id is truncated to the limit,
+// hash uses a hash of it instead, and room a hash of the room id, so a room
+// only shows its latest notification. All are deterministic, so retries
+// collapse as well.
+func (c *APNSConfig) collapseID(pl *RCPayload) string {
+	switch c.CollapseID {
+	case "hash":
+		return hashCollapseID(pl.MessageID)
+	case "room":
+		if pl.Rid != "" {
+			return hashCollapseID(pl.Rid)
+		}
+		return hashCollapseID(pl.MessageID)
+	}
+	if len(pl.MessageID) > apnsMaxCollapseID {
+		return pl.MessageID[:apnsMaxCollapseID]
+	}
+	return pl.MessageID
+}
+
+// hashCollapseID returns a hex encoded hash of id that fits the
+// apns-collapse-id, or "" for no id
+func hashCollapseID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// apnsTopicSuffixPushTypes maps the supported topic suffixes to the push type
+// Apple requires for them
+var apnsTopicSuffixPushTypes = map[string]apns2.EPushType{
+	".voip":         apns2.PushTypeVOIP,
+	".complication": apns2.PushTypeComplication,
+}
+
+// topicPushType checks whether topic is one of the configured topics, or one
+// of them with an accepted suffix, and returns the push type the suffix
+// requires
+func (c *APNSConfig) topicPushType(topic string) (apns2.EPushType, bool) {
+	for _, base := range c.topics() {
+		if pushType, ok := suffixPushType(base, c.TopicSuffixes, topic); ok {
+			return pushType, true
+		}
+	}
+	return "", false
+}
+
+func suffixPushType(base string, suffixes []string, topic string) (apns2.EPushType, bool) {
+	if topic == base {
+		return "", true
+	}
+	for _, suffix := range suffixes {
+		if topic == base+suffix {
+			return apnsTopicSuffixPushTypes[suffix], true
+		}
+	}
+	return "", false
+}
+
+// pushType returns the apns-push-type and the matching apns-priority.
+// Silent notifications without alert, sound and badge are background pushes,
+// which Apple only accepts with low priority, everything else is a user
+// visible alert. This includes message-id-only notifications, iOS neither
+// shows background pushes nor runs the notification service extension for
+// them.
+func (c *APNSConfig) pushType(silent bool) (apns2.EPushType, int) {
+	if silent {
+		return apns2.PushTypeBackground, apns2.PriorityLow
+	}
+	return apns2.PushTypeAlert, c.Priority
+}
+
+// apnsMaxPayload is the maximum size of an APNs payload in bytes
+const apnsMaxPayload = 4096
+
+var errPayloadTooLarge = errors.New("payload exceeds the APNs limit")
+
+// truncateText shortens s by at least n bytes at a rune boundary and marks
+// it with an ellipsis, or returns "" if nothing would remain
+func truncateText(s string, n int) string {
+	const ellipsis = "…"
+	keep := len(s) - n - len(ellipsis)
+	for keep > 0 && !utf8.RuneStart(s[keep]) {
+		keep--
+	}
+	if keep <= 0 {
+		return ""
+	}
+	return s[:keep] + ellipsis
+}
+
+// fitPayload truncates the alert body, and then the title, until the
+// payload fits the APNs limit, setting them with setAlert. It reports whether
+// it truncated anything, and returns errPayloadTooLarge if the payload is too
+// large even without them.
+func fitPayload(p *payload.Payload, title, body string, setAlert alertSetter) (bool, error) {
+	excess := func() int {
+		b, _ := json.Marshal(p)
+		return len(b) - apnsMaxPayload
+	}
+	n := excess()
+	if n <= 0 {
+		return false, nil
+	}
+	// the escaping in JSON can make a cut less effective, so repeat
+	for ; n > 0 && body != ""; n = excess() {
+		body = truncateText(body, n)
+		setAlert(p, title, body)
+	}
+	for ; n > 0 && title != ""; n = excess() {
+		title = truncateText(title, n)
+		setAlert(p, title, body)
+	}
+	if n > 0 {
+		return true, errPayloadTooLarge
+	}
+	return true, nil
+}
+
+// loadAPNSCert loads the APNs certificate from the base64 encoded P12 if
+// set, from the PEM cert and key files if they are set, and from the P12 file
+// otherwise
+func loadAPNSCert(cfg *APNSConfig) (tls.Certificate, error) {
+	if cfg.CertBase64 != "" {
+		log.Println("Using APNs certificate from RCPG_APNS_CERT_BASE64")
+		p12, err := base64.StdEncoding.DecodeString(cfg.CertBase64)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("decoding RCPG_APNS_CERT_BASE64: %w", err)
+		}
+		return certificate.FromP12Bytes(p12, cfg.CertPass)
+	}
+	if cfg.CertPEMFile == "" && cfg.KeyPEMFile == "" {
+		log.Println("Using APNs certificate from RCPG_APNS_CERT_FILE")
+		return certificate.FromP12File(cfg.CertFile, cfg.CertPass)
+	}
+	log.Println("Using APNs certificate from RCPG_APNS_CERT_PEM_FILE and RCPG_APNS_KEY_PEM_FILE")
+	certPEM, err := os.ReadFile(cfg.CertPEMFile)
 	if err != nil {
-		log.Fatal("Cert Error:", err)
+		return tls.Certificate{}, fmt.Errorf("reading PEM certificate: %w", err)
 	}
-	// apnsClient := apns2.NewClient(cert).Development()
-	client := apns2.NewClient(cert).Production()
+	keyPEM, err := os.ReadFile(cfg.KeyPEMFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("reading PEM key: %w", err)
+	}
+	cert, err := certificate.FromPemBytes(append(append(certPEM, '\n'), keyPEM...), cfg.CertPass)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading PEM files %s and %s: %w", cfg.CertPEMFile, cfg.KeyPEMFile, err)
+	}
+	return cert, nil
+}
 
+func getAPNPushNotificationHandler(cfg *Config) func(http.ResponseWriter, *rcRequest) {
+	cert, err := loadAPNSCert(&cfg.APNS)
+	if err != nil {
+		log.Fatal("Cert Error: ", err)
+	}
+	if cfg.APNS.Connections > 1 {
+		log.Printf("Using %d APNs connections", cfg.APNS.Connections)
+	}
+	client := newAPNSClients(cert, cfg.APNS.Connections)
+	if cfg.StartupCheck {
+		for _, topic := range cfg.APNS.topics() {
+			reportStartupCheck("APNs topic "+topic, checkAPNS(client, &cfg.APNS, topic), cfg.StartupCheckFatal)
+		}
+	}
+	watchCredentials(cfg.CredentialsCheckInterval, "APNs certificate", cfg.APNS.certFiles(), func() error {
+		cert, err := loadAPNSCert(&cfg.APNS)
+		if err != nil {
+			return err
+		}
+		client.setCert(cert)
+		return nil
+	})
+	return newAPNHandler(cfg, newAPNSBatcher(client, cfg.APNS.BatchWindow))
+}
+
+// apnsPusher sends notifications to APNs
+type apnsPusher interface {
+	Push(ctx context.Context, n *apns2.Notification) (*apns2.Response, error)
+}
+
+// newAPNHandler returns the handler that sends the notifications with pusher
+func newAPNHandler(cfg *Config, pusher apnsPusher) func(http.ResponseWriter, *rcRequest) {
 	return func(w http.ResponseWriter, r *rcRequest) {
-		r.stats.apn.Add(1)
+		if !r.retry {
+			r.stats.apn.Add(1)
+		}
+		r.backend = "apn"
 
 		opt := &r.data.Options
 
-		if opt.Topic == apnsUpstreamTopic {
-			forward(w, r)
+		if opt.Topic == "" {
+			r.Errorf("Missing APNs topic")
+			writeError(w, http.StatusBadRequest, "MissingField", "missing field: options.topic")
 			return
 		}
 
-		if opt.Topic != apnsTopic {
+		if _, ok := suffixPushType(apnsUpstreamTopic, cfg.APNS.TopicSuffixes, opt.Topic); ok {
+			forward(w, r, cfg, "apn")
+			return
+		}
+
+		topicPushType, ok := cfg.APNS.topicPushType(opt.Topic)
+		if !ok {
 			r.Errorf("Unknown APNs topic: %s", opt.Topic)
-			w.WriteHeader(http.StatusNotAcceptable)
+			writeError(w, http.StatusNotAcceptable, apns2.ReasonTopicDisallowed, "unknown APNs topic: "+opt.Topic)
+			return
+		}
+
+		if opt.Apn != nil && opt.Apn.PushType != "" &&
+			opt.Apn.PushType != string(apns2.PushTypeAlert) && opt.Apn.PushType != string(apns2.PushTypeBackground) {
+			r.Errorf("Unsupported APNs push type: %s", opt.Apn.PushType)
+			writeError(w, http.StatusBadRequest, apns2.ReasonInvalidPushType, "unsupported push type: "+opt.Apn.PushType)
+			return
+		}
+
+		if !cfg.APNS.isValidToken(r.data.Token) {
+			r.Printf("Deleting malformed token: %s", r.data.Token)
+			r.invalidToken(r.data.Token, "apn", apns2.ReasonBadDeviceToken)
+			r.tokenDeleted = true
+			writeError(w, cfg.InvalidTokenStatus, apns2.ReasonBadDeviceToken, "malformed device token")
 			return
 		}
 
+		body := opt.Text
+		if opt.Apn != nil && opt.Apn.Text != "" {
+			body = opt.Apn.Text
+		}
+		setAlert, localized := alertSetter(setLiteralAlert), false
+		if cfg.APNS.LocKeys {
+			if set, ok := locAlert(opt.Payload); ok {
+				setAlert, localized = set, true
+			}
+		}
+
 		// Create the notification payload
-		p := payload.NewPayload().
-			AlertTitle(opt.Title).
-			AlertBody(opt.Text).
-			Badge(opt.Badge).
-			Sound(opt.Sound).
-			Custom("ejson", string(r.ejson))
+		p := payload.NewPayload().Custom("ejson", string(r.ejson))
+		sound := r.getSound(cfg)
+		// the default badge would turn every silent push into an alert
+		_, requestedBadge := cfg.badge(opt.Badge)
+		silent := opt.Title == "" && body == "" && !localized && sound == "" && !requestedBadge
+		if !silent {
+			setAlert(p, opt.Title, body)
+			if badge, ok := r.getBadge(cfg); ok {
+				p.Badge(badge)
+			}
+		}
+
+		if sound != "" {
+			p.Sound(sound)
+		}
+
+		if cfg.APNS.ThreadID && opt.Payload != nil && opt.Payload.Rid != "" {
+			p.ThreadID(opt.Payload.Rid)
+		}
+
+		if level := cfg.APNS.interruptionLevel(opt.Payload); level != "" {
+			p.InterruptionLevel(level)
+		}
 
 		if opt.Apn != nil {
 			if opt.Apn.Category != "" {
 				p.Category(opt.Apn.Category)
 			}
-			if opt.Apn.Text != "" {
-				p.AlertBody(opt.Apn.Text)
+			if opt.Apn.Critical && !r.isMessageIDOnly() {
+				if cfg.APNS.CriticalAlerts {
+					setCriticalSound(p, sound, opt.Apn.Volume)
+				} else {
+					r.Debugf("Ignoring critical alert, RCPG_APNS_CRITICAL_ALERTS is not enabled")
+				}
 			}
 		}
 
-		if opt.Payload != nil && opt.Payload.NotificationType == "message-id-only" {
+		if subtitle := getSubtitle(opt.Title, opt.Payload); subtitle != "" && !localized {
+			p.AlertSubtitle(subtitle)
+		}
+
+		// the notification service extension of the app fetches the content
+		// of message-id-only notifications and can attach images
+		messageIDOnly := r.isMessageIDOnly()
+		if messageIDOnly || opt.Gcm != nil && opt.Gcm.Image != "" {
 			p.MutableContent()
 		}
 
+		pushType, priority := cfg.APNS.pushType(silent)
+		if opt.Apn != nil && opt.Apn.PushType != "" {
+			pushType, priority = cfg.APNS.pushType(opt.Apn.PushType == string(apns2.PushTypeBackground))
+		}
+		if topicPushType != "" {
+			// VoIP and complication pushes wake the app, they need to be
+			// delivered immediately
+			pushType, priority = topicPushType, apns2.PriorityHigh
+		}
+		if pushType == apns2.PushTypeBackground || opt.Apn != nil && opt.Apn.ContentAvailable {
+			p.ContentAvailable()
+		}
+
+		truncated, err := fitPayload(p, opt.Title, body, setAlert)
+		if err != nil {
+			r.Errorf("Failed to create notification: %v", err)
+			r.stats.apnsPayloadErrors.Add(1)
+			writeError(w, http.StatusRequestEntityTooLarge, apns2.ReasonPayloadTooLarge, err.Error())
+			return
+		}
+		if truncated {
+			r.Printf("Truncated the notification to fit the APNs payload limit")
+		}
+
 		// Create the notification
 		n := &apns2.Notification{
 			DeviceToken: r.data.Token,
 			Topic:       opt.Topic,
+			Expiration:  cfg.APNS.expiration(messageIDOnly),
+			PushType:    pushType,
+			Priority:    priority,
 			Payload:     p,
 		}
 
+		if opt.Payload != nil {
+			n.CollapseID = cfg.APNS.collapseID(opt.Payload)
+		}
+		if r.apnsExpiration != nil {
+			n.Expiration = *r.apnsExpiration
+		}
+		if r.apnsPriority != 0 {
+			n.Priority = r.apnsPriority
+			// APNs rejects background notifications with another priority
+			if n.PushType == apns2.PushTypeBackground && n.Priority != apns2.PriorityLow {
+				r.Debugf("Clamping apns-priority %d of a background notification to 5", n.Priority)
+				n.Priority = apns2.PriorityLow
+			}
+		}
+
 		nJSON, _ := n.MarshalJSON()
 		r.Debugf("Sending notification: %s", nJSON)
 
 		// Send the notification
-		res, err := client.Push(n)
+		ctx, cancel := r.sendContext(cfg)
+		if !r.acquireSend(ctx, w, cfg.pool) {
+			cancel()
+			return
+		}
+		ctx, span := startBackendSpan(ctx, "apns.push", "apn")
+		res, err := pusher.Push(ctx, n)
+		if res != nil {
+			span.SetAttributes(semconv.HTTPStatusCode(res.StatusCode), attribute.String("apns.reason", res.Reason))
+		}
+		endSpan(span, err)
+		cancel()
+		cfg.pool.release()
 		if err != nil {
 			r.Errorf("Failed to send notification: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "SendFailed", err.Error())
 			return
 		}
 
 		if !res.Sent() {
-			if res.Reason == apns2.ReasonBadDeviceToken ||
-				res.Reason == apns2.ReasonDeviceTokenNotForTopic ||
-				res.Reason == apns2.ReasonUnregistered {
+			if cfg.APNS.InvalidTokenReasons[res.Reason] {
 				r.Printf("Deleting invalid token: %s", r.data.Token)
-				w.WriteHeader(http.StatusNotAcceptable)
+				r.invalidToken(r.data.Token, "apn", res.Reason)
+				r.tokenDeleted = true
+				writeError(w, cfg.InvalidTokenStatus, res.Reason, "invalid device token")
 				return
 			}
 			r.Errorf("Failed to send notification: %+v", res)
-			w.WriteHeader(res.StatusCode)
+			r.stats.countRejection(res)
+			writeError(w, res.StatusCode, res.Reason, "APNs rejected the notification")
 			return
 		}
 
 		r.Debugf("Notification sent: %+v", res)
 
-		w.WriteHeader(http.StatusOK)
-		r.Printf("Notification sent to APNS")
+		cfg.writeSuccess(w, successResponse{Backend: "apn", Sent: true, ApnsID: res.ApnsID})
+		r.Printf("Notification sent to APNS, apns-id: %s", res.ApnsID)
 	}
 }
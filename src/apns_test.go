@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+)
+
+const testTopic = "com.example.rocketchat"
+
+var testAPNSToken = strings.Repeat("ab", apnsTokenLength/2)
+
+// fakePusher records the notification and returns a canned result
+type fakePusher struct {
+	res *apns2.Response
+	err error
+	n   *apns2.Notification
+}
+
+func (p *fakePusher) Push(_ context.Context, n *apns2.Notification) (*apns2.Response, error) {
+	p.n = n
+	return p.res, p.err
+}
+
+// roundTripFunc fakes the upstream gateway
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeUpstream records the forwarded request and responds with status
+func fakeUpstream(status int, forwarded **http.Request) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		*forwarded = r
+		return &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+}
+
+func testConfig(upstream http.RoundTripper) *Config {
+	return testConfigEnv(upstream, nil)
+}
+
+// testConfigEnv parses the variables of env on top of the test defaults and
+// forwards to upstream
+func testConfigEnv(upstream http.RoundTripper, env map[string]string) *Config {
+	defaults := map[string]string{
+		"RCPG_APNS_TOPIC":      testTopic,
+		"RCPG_APNS_CERT_FILE":  "test.p12",
+		"RCPG_FCM_KEY_JSON":    "{}",
+		"RCPG_FORWARD_TIMEOUT": "1s",
+	}
+	cfg, err := parseConfig(func(name string) string {
+		if v, ok := env[name]; ok {
+			return v
+		}
+		return defaults[name]
+	})
+	if err != nil {
+		panic(err)
+	}
+	cfg.Forward.client = &http.Client{Transport: upstream}
+	return cfg
+}
+
+func pushRequest(path, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// apnsBody returns the request body of testNotification
+func apnsBody(token, topic string) string {
+	return notificationBody(testNotification(token, topic))
+}
+
+// testNotification returns a message notification, for tests that vary its
+// fields
+func testNotification(token, topic string) *RCPushNotification {
+	n := &RCPushNotification{Token: token}
+	n.Options.Title, n.Options.Text = "Alice", "Hello"
+	n.Options.Topic, n.Options.UniqueID = topic, "test"
+	n.Options.Payload = &RCPayload{Host: "https://chat.example.com", MessageID: "m1", NotificationType: "message", Rid: "r1"}
+	return n
+}
+
+// notificationBody returns n marshaled as request body
+func notificationBody(n *RCPushNotification) string {
+	b, err := json.Marshal(n)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestAPNHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		topic     string
+		res       *apns2.Response
+		status    int
+		pushed    bool
+		forwarded bool
+	}{
+		{"success", testAPNSToken, testTopic, &apns2.Response{StatusCode: 200, ApnsID: "id"}, http.StatusOK, true, false},
+		{"unregistered", testAPNSToken, testTopic, &apns2.Response{StatusCode: 410, Reason: apns2.ReasonUnregistered}, http.StatusNotAcceptable, true, false},
+		{"bad token", testAPNSToken, testTopic, &apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadDeviceToken}, http.StatusNotAcceptable, true, false},
+		{"malformed token", "not-a-token", testTopic, nil, http.StatusNotAcceptable, false, false},
+		{"rejected", testAPNSToken, testTopic, &apns2.Response{StatusCode: 429, Reason: apns2.ReasonTooManyRequests}, http.StatusTooManyRequests, true, false},
+		{"forward", testAPNSToken, apnsUpstreamTopic, nil, http.StatusOK, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			cfg := testConfig(fakeUpstream(http.StatusOK, &forwarded))
+			pusher := &fakePusher{res: tt.res}
+			handler := withRCRequest(cfg, newAPNHandler(cfg, pusher), false)
+
+			w := httptest.NewRecorder()
+			handler(w, pushRequest("/push/apn/send", apnsBody(tt.token, tt.topic)))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if (pusher.n != nil) != tt.pushed {
+				t.Errorf("pushed = %t, want %t", pusher.n != nil, tt.pushed)
+			}
+			if (forwarded != nil) != tt.forwarded {
+				t.Fatalf("forwarded = %t, want %t", forwarded != nil, tt.forwarded)
+			}
+			if forwarded != nil && forwarded.URL.String() != "https://"+upstreamGateway+"/push/apn/send" {
+				t.Errorf("forwarded to %s", forwarded.URL)
+			}
+		})
+	}
+}
+
+func TestAPNHandlerForwardDisabled(t *testing.T) {
+	var forwarded *http.Request
+	cfg := testConfig(fakeUpstream(http.StatusOK, &forwarded))
+	cfg.Forward.Enabled = false
+	handler := withRCRequest(cfg, newAPNHandler(cfg, &fakePusher{}), false)
+
+	w := httptest.NewRecorder()
+	handler(w, pushRequest("/push/apn/send", apnsBody(testAPNSToken, apnsUpstreamTopic)))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	if forwarded != nil {
+		t.Error("forwarded although forwarding is disabled")
+	}
+}
+
+func TestAPNHandlerForwardSingleFlight(t *testing.T) {
+	var calls atomic.Int32
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	cfg := testConfig(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		entered <- struct{}{}
+		<-release
+		return &http.Response{
+			StatusCode: http.StatusBadGateway,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}))
+	cfg.Forward.SingleFlight = true
+	handler := withRCRequest(cfg, newAPNHandler(cfg, &fakePusher{}), false)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	send := func(i int, token string) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		handler(w, pushRequest("/push/apn/send", apnsBody(token, apnsUpstreamTopic)))
+		codes[i] = w.Code
+	}
+	otherToken := strings.Repeat("cd", apnsTokenLength/2)
+	wg.Add(3)
+	go send(0, testAPNSToken)
+	<-entered
+	go send(1, testAPNSToken)
+	go send(2, otherToken)
+	<-entered
+	// give the identical forward time to join the first one
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+	for i, code := range codes {
+		if code != http.StatusBadGateway {
+			t.Errorf("status %d = %d, want 502", i, code)
+		}
+	}
+}
+
+func TestAPNHandlerForwardDeliveryIDs(t *testing.T) {
+	cfg := testConfigEnv(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Apns-Id": {"upstream-id"}},
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}), map[string]string{"RCPG_SUCCESS_BODY": "true"})
+	handler := withRCRequest(cfg, newAPNHandler(cfg, &fakePusher{}), false)
+	w := httptest.NewRecorder()
+	handler(w, pushRequest("/push/apn/send", apnsBody(testAPNSToken, apnsUpstreamTopic)))
+
+	var resp successResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Backend != "forwarded" || resp.ApnsID != "upstream-id" {
+		t.Errorf("response = %+v, want the apns-id of upstream", resp)
+	}
+}
+
+// setAPN sets the APNs options of n, which is an anonymous struct
+func setAPN(n *RCPushNotification, pushType string, contentAvailable bool) {
+	json.Unmarshal([]byte("{}"), &n.Options.Apn)
+	n.Options.Apn.PushType = pushType
+	n.Options.Apn.ContentAvailable = contentAvailable
+}
+
+func TestAPNHandlerNotification(t *testing.T) {
+	badge := func(n int) *int { return &n }
+	tests := []struct {
+		name   string
+		env    map[string]string
+		path   string
+		header map[string]string
+		edit   func(n *RCPushNotification)
+		status int
+		// the pushed notification, if status is 200
+		pushType   apns2.EPushType
+		priority   int
+		collapseID string
+		// contains and omits are checked against the marshaled payload
+		contains []string
+		omits    []string
+	}{
+		{name: "alert", pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, collapseID: "m1",
+			contains: []string{`"title":"Alice"`, `"body":"Hello"`, `"thread-id":"r1"`, `\"messageId\":\"m1\"`}},
+		{name: "thread-id disabled", env: map[string]string{"RCPG_APNS_THREAD_ID": "false"},
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, omits: []string{`"thread-id"`}},
+		{name: "no room", edit: func(n *RCPushNotification) { n.Options.Payload.Rid = "" },
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, omits: []string{`"thread-id"`}},
+		{name: "low priority", env: map[string]string{"RCPG_APNS_PRIORITY": "5"},
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityLow},
+		{name: "low priority background", env: map[string]string{"RCPG_APNS_PRIORITY": "5"},
+			edit:     func(n *RCPushNotification) { setAPN(n, "background", false) },
+			pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow},
+		{name: "low priority voip", env: map[string]string{"RCPG_APNS_PRIORITY": "5", "RCPG_APNS_TOPIC_SUFFIXES": ".voip"},
+			edit:     func(n *RCPushNotification) { n.Options.Topic = testTopic + ".voip" },
+			pushType: apns2.PushTypeVOIP, priority: apns2.PriorityHigh},
+		{name: "filter route", path: "/filter/push/apn/send", pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh,
+			contains: []string{`"mutable-content":1`}, omits: []string{`"content-available"`, "Alice", "Hello"}},
+		{name: "message-id-only", edit: func(n *RCPushNotification) {
+			n.Options.Payload.NotificationType = "message-id-only"
+		}, pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh,
+			contains: []string{`"mutable-content":1`}, omits: []string{`"content-available"`}},
+		{name: "message-id-only without alert", edit: func(n *RCPushNotification) {
+			n.Options.Title, n.Options.Text, n.Options.Payload.NotificationType = "", "", "message-id-only"
+		}, pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow,
+			contains: []string{`"mutable-content":1`, `"content-available":1`}, omits: []string{`"alert"`}},
+		{name: "forced message-id-only", env: map[string]string{"RCPG_FORCE_MESSAGE_ID_ONLY": "true"},
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh,
+			contains: []string{`"alert":{"body":"` + defaultFilterMessage + `"}`, `\"messageId\":\"m1\"`, `\"host\":\"https://chat.example.com\"`},
+			omits:    []string{"Alice", "Hello", `\"rid\"`}},
+		{name: "subtitle", edit: func(n *RCPushNotification) {
+			n.Options.Payload.Type, n.Options.Payload.Name = "c", "general"
+		}, pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, contains: []string{`"subtitle":"general"`}},
+		{name: "loc keys", env: map[string]string{"RCPG_APNS_LOC_KEYS": "true"}, edit: func(n *RCPushNotification) {
+			n.Options.Payload.Type, n.Options.Payload.Name, n.Options.Payload.SenderName = "c", "general", "Alice"
+		}, pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh,
+			contains: []string{`"title-loc-key":"PUSH_ROOM_TITLE"`, `"title-loc-args":["Alice","general"]`,
+				`"loc-key":"PUSH_MESSAGE"`, `"loc-args":["Hello"]`},
+			omits: []string{`"body"`, `"subtitle"`}},
+		{name: "silent", edit: func(n *RCPushNotification) {
+			n.Options.Title, n.Options.Text, n.Options.Payload.Rid = "", "", ""
+		}, pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow, contains: []string{`"aps":{"content-available":1}`}},
+		{name: "silent with badge", edit: func(n *RCPushNotification) {
+			n.Options.Title, n.Options.Text, n.Options.Badge = "", "", badge(3)
+		}, pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, contains: []string{`"badge":3`}, omits: []string{`"content-available"`}},
+		{name: "silent with omitted badge", env: map[string]string{"RCPG_BADGE_OMIT_VALUE": "0"}, edit: func(n *RCPushNotification) {
+			n.Options.Title, n.Options.Text, n.Options.Badge = "", "", badge(0)
+		}, pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow, omits: []string{`"badge"`}},
+		{name: "alert with default badge", pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, contains: []string{`"badge":0`}},
+		{name: "background hint", edit: func(n *RCPushNotification) { setAPN(n, "background", false) },
+			pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow, contains: []string{`"content-available":1`}},
+		{name: "background hint with high priority header", header: map[string]string{"apns-priority": "10"},
+			edit:     func(n *RCPushNotification) { setAPN(n, "background", false) },
+			pushType: apns2.PushTypeBackground, priority: apns2.PriorityLow},
+		{name: "alert hint with content-available", edit: func(n *RCPushNotification) { setAPN(n, "alert", true) },
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, contains: []string{`"content-available":1`}},
+		{name: "content-available", edit: func(n *RCPushNotification) { setAPN(n, "", true) },
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh, contains: []string{`"content-available":1`}},
+		{name: "voip hint", edit: func(n *RCPushNotification) { setAPN(n, "voip", false) }, status: http.StatusBadRequest},
+		{name: "voip topic suffix", env: map[string]string{"RCPG_APNS_TOPIC_SUFFIXES": ".voip"},
+			edit:     func(n *RCPushNotification) { n.Options.Topic = testTopic + ".voip" },
+			pushType: apns2.PushTypeVOIP, priority: apns2.PriorityHigh},
+		{name: "disabled topic suffix", env: map[string]string{"RCPG_APNS_TOPIC_SUFFIXES": ".voip"},
+			edit:   func(n *RCPushNotification) { n.Options.Topic = testTopic + ".complication" },
+			status: http.StatusNotAcceptable},
+		{name: "additional topic", env: map[string]string{"RCPG_APNS_TOPICS": "com.example.other"},
+			edit:     func(n *RCPushNotification) { n.Options.Topic = "com.example.other" },
+			pushType: apns2.PushTypeAlert, priority: apns2.PriorityHigh},
+		{name: "unknown topic", env: map[string]string{"RCPG_APNS_TOPICS": "com.example.other"},
+			edit:   func(n *RCPushNotification) { n.Options.Topic = "com.example.unknown" },
+			status: http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfigEnv(nil, tt.env)
+			pusher := &fakePusher{res: &apns2.Response{StatusCode: 200}}
+			path := tt.path
+			if path == "" {
+				path = "/push/apn/send"
+			}
+			handler := withRCRequest(cfg, newAPNHandler(cfg, pusher), strings.HasPrefix(path, "/filter/"))
+			n := testNotification(testAPNSToken, testTopic)
+			if tt.edit != nil {
+				tt.edit(n)
+			}
+			req := pushRequest(path, notificationBody(n))
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if w.Code != status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+			}
+			if status != http.StatusOK {
+				if pusher.n != nil {
+					t.Error("rejected notification was pushed")
+				}
+				return
+			}
+			if pusher.n == nil {
+				t.Fatal("no notification pushed")
+			}
+			if pusher.n.Topic != n.Options.Topic {
+				t.Errorf("topic = %s, want %s", pusher.n.Topic, n.Options.Topic)
+			}
+			if pusher.n.PushType != tt.pushType || pusher.n.Priority != tt.priority {
+				t.Errorf("push type = %s, priority = %d, want %s, %d", pusher.n.PushType, pusher.n.Priority, tt.pushType, tt.priority)
+			}
+			if tt.collapseID != "" && pusher.n.CollapseID != tt.collapseID {
+				t.Errorf("collapse id = %q, want %q", pusher.n.CollapseID, tt.collapseID)
+			}
+			b, _ := json.Marshal(pusher.n.Payload)
+			for _, want := range tt.contains {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("payload without %s: %s", want, b)
+				}
+			}
+			for _, unwanted := range tt.omits {
+				if strings.Contains(string(b), unwanted) {
+					t.Errorf("payload with %s: %s", unwanted, b)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPushType(t *testing.T) {
+	tests := []struct {
+		alertPriority int
+		silent        bool
+		pushType      apns2.EPushType
+		priority      int
+	}{
+		{apns2.PriorityHigh, false, apns2.PushTypeAlert, apns2.PriorityHigh},
+		{apns2.PriorityHigh, true, apns2.PushTypeBackground, apns2.PriorityLow},
+		{apns2.PriorityLow, false, apns2.PushTypeAlert, apns2.PriorityLow},
+		{apns2.PriorityLow, true, apns2.PushTypeBackground, apns2.PriorityLow},
+	}
+	for _, tt := range tests {
+		cfg := &APNSConfig{Priority: tt.alertPriority}
+		pushType, priority := cfg.pushType(tt.silent)
+		if pushType != tt.pushType || priority != tt.priority {
+			t.Errorf("pushType(%t) with priority %d = %s, %d, want %s, %d",
+				tt.silent, tt.alertPriority, pushType, priority, tt.pushType, tt.priority)
+		}
+	}
+}
+
+func TestAPNSConfigPriority(t *testing.T) {
+	for _, priority := range []string{"1", "7", "high"} {
+		env := map[string]string{
+			"RCPG_APNS_CERT_FILE": "test.p12",
+			"RCPG_FCM_KEY_JSON":   "{}",
+			"RCPG_APNS_PRIORITY":  priority,
+		}
+		_, err := parseConfig(func(name string) string { return env[name] })
+		if err == nil || !strings.Contains(err.Error(), "RCPG_APNS_PRIORITY") {
+			t.Errorf("RCPG_APNS_PRIORITY=%s: error = %v", priority, err)
+		}
+	}
+}
+
+func TestGetCollapseID(t *testing.T) {
+	long := strings.Repeat("m", apnsMaxCollapseID) + "1"
+	other := strings.Repeat("m", apnsMaxCollapseID) + "2"
+	tests := []struct {
+		strategy string
+		pl       *RCPayload
+		want     string
+	}{
+		{"raw", &RCPayload{MessageID: "m1"}, "m1"},
+		{"raw", &RCPayload{MessageID: long}, long[:apnsMaxCollapseID]},
+		{"hash", &RCPayload{MessageID: ""}, ""},
+		{"hash", &RCPayload{MessageID: long}, hashCollapseID(long)},
+		{"room", &RCPayload{MessageID: long, Rid: "r1"}, hashCollapseID("r1")},
+		{"room", &RCPayload{MessageID: long}, hashCollapseID(long)},
+	}
+	for _, tt := range tests {
+		c := &APNSConfig{CollapseID: tt.strategy}
+		got := c.collapseID(tt.pl)
+		if got != tt.want || len(got) > apnsMaxCollapseID {
+			t.Errorf("%s: collapseID(%+v) = %q, want %q", tt.strategy, tt.pl, got, tt.want)
+		}
+		// retries of the same message have to collapse
+		if again := c.collapseID(tt.pl); again != got {
+			t.Errorf("%s: collapseID(%+v) isn't deterministic: %q, %q", tt.strategy, tt.pl, got, again)
+		}
+	}
+	// hashing keeps over-length ids with the same prefix apart
+	if hashCollapseID(long) == hashCollapseID(other) {
+		t.Error("hashes of different message ids collide")
+	}
+}
+
+func TestGetSubtitle(t *testing.T) {
+	tests := []struct {
+		title string
+		pl    *RCPayload
+		want  string
+	}{
+		{"Alice", nil, ""},
+		{"Alice", &RCPayload{Type: "c", Name: "general"}, "general"},
+		{"Alice", &RCPayload{Type: "d", Name: "alice"}, ""},
+		{"general", &RCPayload{Type: "c", Name: "general"}, ""},
+		{"Alice", &RCPayload{Type: "p"}, ""},
+	}
+	for _, tt := range tests {
+		if got := getSubtitle(tt.title, tt.pl); got != tt.want {
+			t.Errorf("getSubtitle(%q, %+v) = %q, want %q", tt.title, tt.pl, got, tt.want)
+		}
+	}
+}
+
+func TestCountRejection(t *testing.T) {
+	tests := []struct {
+		res  apns2.Response
+		want func(*status) uintptr
+	}{
+		{apns2.Response{StatusCode: 403, Reason: apns2.ReasonExpiredProviderToken}, func(s *status) uintptr { return s.apnsAuthErrors.Load() }},
+		{apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadTopic}, func(s *status) uintptr { return s.apnsAuthErrors.Load() }},
+		{apns2.Response{StatusCode: 413, Reason: apns2.ReasonPayloadTooLarge}, func(s *status) uintptr { return s.apnsPayloadErrors.Load() }},
+		{apns2.Response{StatusCode: 429, Reason: apns2.ReasonTooManyRequests}, func(s *status) uintptr { return s.apnsRateErrors.Load() }},
+		{apns2.Response{StatusCode: 503, Reason: apns2.ReasonServiceUnavailable}, func(s *status) uintptr { return s.apnsServerErrors.Load() }},
+		{apns2.Response{StatusCode: 502}, func(s *status) uintptr { return s.apnsServerErrors.Load() }},
+	}
+	for _, tt := range tests {
+		s := &status{}
+		s.countRejection(&tt.res)
+		if got := tt.want(s); got != 1 {
+			t.Errorf("countRejection(%d %s) not counted in the expected bucket", tt.res.StatusCode, tt.res.Reason)
+		}
+	}
+}
+
+func TestCheckAPNS(t *testing.T) {
+	cfg := testConfig(nil)
+	tests := []struct {
+		res  *apns2.Response
+		err  error
+		pass bool
+	}{
+		{&apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadDeviceToken}, nil, true},
+		{&apns2.Response{StatusCode: 403, Reason: apns2.ReasonBadCertificate}, nil, false},
+		{&apns2.Response{StatusCode: 400, Reason: apns2.ReasonTopicDisallowed}, nil, false},
+		{&apns2.Response{StatusCode: 200}, nil, false},
+		{nil, fmt.Errorf("connection refused"), false},
+	}
+	for _, tt := range tests {
+		err := checkAPNS(&fakePusher{res: tt.res, err: tt.err}, &cfg.APNS, testTopic)
+		if (err == nil) != tt.pass {
+			t.Errorf("checkAPNS(%+v, %v) = %v, want pass %t", tt.res, tt.err, err, tt.pass)
+		}
+	}
+}
+
+func TestAPNHandlerHeaders(t *testing.T) {
+	tests := []struct {
+		expiration, priority string
+		wantExpiration       int64
+		wantPriority         int
+	}{
+		{"1700000000", "5", 1700000000, apns2.PriorityLow},
+		{"0", "1", 0, 1},
+		{"soon", "7", -1, apns2.PriorityHigh},
+	}
+	cfg := testConfig(nil)
+	for _, tt := range tests {
+		pusher := &fakePusher{res: &apns2.Response{StatusCode: 200}}
+		handler := withRCRequest(cfg, newAPNHandler(cfg, pusher), false)
+		req := pushRequest("/push/apn/send", apnsBody(testAPNSToken, testTopic))
+		req.Header.Set("apns-expiration", tt.expiration)
+		req.Header.Set("apns-priority", tt.priority)
+		handler(httptest.NewRecorder(), req)
+		if pusher.n == nil {
+			t.Fatal("no notification pushed")
+		}
+		if tt.wantExpiration >= 0 && pusher.n.Expiration.Unix() != tt.wantExpiration {
+			t.Errorf("%s: expiration = %d, want %d", tt.expiration, pusher.n.Expiration.Unix(), tt.wantExpiration)
+		}
+		if pusher.n.Priority != tt.wantPriority {
+			t.Errorf("%s: priority = %d, want %d", tt.priority, pusher.n.Priority, tt.wantPriority)
+		}
+	}
+}
+
+func TestAsyncDeliveryCountsOnce(t *testing.T) {
+	cfg := testConfig(nil)
+	pusher := &fakePusher{res: &apns2.Response{StatusCode: 503, Reason: apns2.ReasonServiceUnavailable}}
+	r := &rcRequest{stats: &status{}, http: pushRequest("/push/apn/send", "")}
+	if err := json.Unmarshal([]byte(apnsBody(testAPNSToken, testTopic)), &r.data); err != nil {
+		t.Fatal(err)
+	}
+	a := &asyncDelivery{retries: 1}
+	a.deliver(asyncJob{handler: newAPNHandler(cfg, pusher), r: r})
+
+	if n := r.stats.apn.Load(); n != 1 {
+		t.Errorf("apn counted %d times, want 1", n)
+	}
+	if n := r.stats.asyncFailed.Load(); n != 1 {
+		t.Errorf("asyncFailed = %d, want 1", n)
+	}
+}
+
+func TestAsyncDeliveryQueueFull(t *testing.T) {
+	cfg := testConfig(nil)
+	file := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	var err error
+	if cfg.deadLetters, err = openDeadLetterFile(file); err != nil {
+		t.Fatal(err)
+	}
+	// without workers and buffer the queue is always full
+	cfg.async = &asyncDelivery{queue: make(chan asyncJob)}
+	pusher := &fakePusher{res: &apns2.Response{StatusCode: 200}}
+	handler := withRCRequest(cfg, newAPNHandler(cfg, pusher), false)
+	w := httptest.NewRecorder()
+	handler(w, pushRequest("/push/apn/send", apnsBody(testAPNSToken, testTopic)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	cfg.deadLetters.pending.wait(context.Background())
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l deadLetter
+	if err := json.Unmarshal(data, &l); err != nil {
+		t.Fatalf("dead letter %q: %v", data, err)
+	}
+	if l.Status != http.StatusServiceUnavailable {
+		t.Errorf("dead letter = %+v, want status 503", l)
+	}
+}
+
+// batchPusher records the pushed notifications, each push blocks until
+// release is closed
+type batchPusher struct {
+	mu      sync.Mutex
+	pushed  []time.Duration
+	start   time.Time
+	release chan struct{}
+}
+
+func (p *batchPusher) Push(ctx context.Context, n *apns2.Notification) (*apns2.Response, error) {
+	p.mu.Lock()
+	p.pushed = append(p.pushed, time.Since(p.start))
+	p.mu.Unlock()
+	<-p.release
+	return &apns2.Response{StatusCode: 200, ApnsID: n.ApnsID}, nil
+}
+
+func (p *batchPusher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pushed)
+}
+
+func TestAPNSBatcherFlush(t *testing.T) {
+	pusher := &batchPusher{start: time.Now(), release: make(chan struct{})}
+	b := newAPNSBatcher(pusher, 50*time.Millisecond)
+	const n = 3
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := b.Push(context.Background(), &apns2.Notification{DeviceToken: testAPNSToken, ApnsID: fmt.Sprint(i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = res.ApnsID
+		}(i)
+	}
+	// the pushes block until released, so all of them in flight at once
+	// means they went out in one flush
+	deadline := time.Now().Add(time.Second)
+	for pusher.count() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(pusher.release)
+	wg.Wait()
+	if len(pusher.pushed) != n {
+		t.Fatalf("%d notifications in flight, want %d flushed together", len(pusher.pushed), n)
+	}
+	for i, d := range pusher.pushed {
+		if d < b.window {
+			t.Errorf("notification %d pushed after %s, before the window", i, d)
+		}
+	}
+	for i, id := range ids {
+		if id != fmt.Sprint(i) {
+			t.Errorf("notification %d got the result of %s", i, id)
+		}
+	}
+	b.mu.Lock()
+	if len(b.pending) != 0 {
+		t.Errorf("%d batches still open", len(b.pending))
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Push(ctx, &apns2.Notification{DeviceToken: testAPNSToken}); err != context.DeadlineExceeded {
+		t.Errorf("push beyond the deadline = %v, want deadline exceeded", err)
+	}
+}
+
+// BenchmarkAPNSClients pushes through RCPG_APNS_CONNECTIONS clients to a fake
+// APNs, which allows 100 concurrent streams per connection and answers after
+// 50ms, with 1000 notifications in flight
+func BenchmarkAPNSClients(b *testing.B) {
+	const (
+		streams  = 100
+		latency  = 50 * time.Millisecond
+		inFlight = 1000
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		w.Header().Set("apns-id", "id")
+	}))
+	http2.ConfigureServer(srv.Config, &http2.Server{MaxConcurrentStreams: streams})
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, conns := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("connections=%d", conns), func(b *testing.B) {
+			p := newAPNSClients(tls.Certificate{}, conns)
+			for _, c := range *p.clients.Load() {
+				c.Host = srv.URL
+				c.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+			}
+			n := &apns2.Notification{DeviceToken: testAPNSToken, Topic: testTopic, Payload: []byte(`{}`)}
+			sem := make(chan struct{}, inFlight)
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sem <- struct{}{}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := p.Push(context.Background(), n); err != nil {
+						b.Error(err)
+					}
+					<-sem
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pushes/s")
+		})
+	}
+}
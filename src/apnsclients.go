@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+)
+
+// apnsClients is a pool of APNs clients, each with its own HTTP/2
+// connection, that are used round-robin. A single connection is limited by
+// the number of concurrent streams APNs allows per connection, so under high
+// load more connections increase the throughput.
+type apnsClients struct {
+	n       int
+	clients atomic.Pointer[[]*apns2.Client]
+	next    atomic.Uint32
+}
+
+// newAPNSClients creates n production clients with cert, at least one
+func newAPNSClients(cert tls.Certificate, n int) *apnsClients {
+	if n < 1 {
+		n = 1
+	}
+	p := &apnsClients{n: n}
+	p.setCert(cert)
+	return p
+}
+
+// setCert replaces the clients with new ones using cert. Notifications in
+// flight finish on the old clients.
+func (p *apnsClients) setCert(cert tls.Certificate) {
+	clients := make([]*apns2.Client, p.n)
+	proxied := usesProxy(apns2.HostProduction)
+	for i := range clients {
+		// clients[i] = apns2.NewClient(cert).Development()
+		clients[i] = apns2.NewClient(cert).Production()
+		if proxied {
+			tlsConfig := clients[i].HTTPClient.Transport.(*http2.Transport).TLSClientConfig
+			clients[i].HTTPClient.Transport = newAPNSProxyTransport(tlsConfig)
+		}
+	}
+	old := p.clients.Swap(&clients)
+	if old != nil {
+		for _, c := range *old {
+			c.HTTPClient.CloseIdleConnections()
+		}
+	}
+}
+
+// Push sends the notification with the next client of the pool
+func (p *apnsClients) Push(ctx context.Context, n *apns2.Notification) (*apns2.Response, error) {
+	clients := *p.clients.Load()
+	i := p.next.Add(1) % uint32(len(clients))
+	return clients[i].PushWithContext(ctx, n)
+}
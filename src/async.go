@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultAsyncQueue   = 1000
+	defaultAsyncWorkers = 4
+	defaultAsyncRetries = 3
+	asyncRetryDelay     = time.Second
+)
+
+// asyncDelivery decouples the request from the backend: requests are queued
+// and answered with 202 immediately, while workers deliver them in the
+// background and retry failed deliveries.
+type asyncDelivery struct {
+	queue   chan asyncJob
+	retries int
+	pending pendingWork
+	// webhook and deadLetters receive the final results, they may be nil
+	webhook     *resultWebhook
+	deadLetters *deadLetterFile
+}
+
+type asyncJob struct {
+	handler func(http.ResponseWriter, *rcRequest)
+	r       *rcRequest
+}
+
+// newAsyncDelivery creates the queue and starts the workers
+func newAsyncDelivery(c AsyncConfig, webhook *resultWebhook, deadLetters *deadLetterFile) *asyncDelivery {
+	a := &asyncDelivery{
+		queue:       make(chan asyncJob, c.Queue),
+		retries:     c.Retries,
+		webhook:     webhook,
+		deadLetters: deadLetters,
+	}
+	for i := 0; i < c.Workers; i++ {
+		go a.worker()
+	}
+	return a
+}
+
+// wrap returns a handler that queues the request for handler
+func (a *asyncDelivery) wrap(handler func(http.ResponseWriter, *rcRequest)) func(http.ResponseWriter, *rcRequest) {
+	return func(w http.ResponseWriter, r *rcRequest) {
+		// the workers get their own copy including the headers, as the
+		// request is still logged after the response while forwarding
+		// modifies the headers, and the request context ends with it
+		job := asyncJob{handler: handler, r: &rcRequest{}}
+		*job.r = *r
+		// the delivery stays part of the trace of the request
+		ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.http.Context()))
+		job.r.http = r.http.Clone(ctx)
+		a.pending.add()
+		select {
+		case a.queue <- job:
+			// the worker reports the result, a rejected request is reported
+			// like any other
+			r.backend = "async"
+			r.Debugf("Queued notification for async delivery")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			a.pending.done()
+			r.Printf("Async delivery queue is full")
+			writeError(w, http.StatusServiceUnavailable, "QueueFull", "async delivery queue is full")
+		}
+	}
+}
+
+func (a *asyncDelivery) worker() {
+	for job := range a.queue {
+		a.deliver(job)
+		a.pending.done()
+	}
+}
+
+// deliver runs the handler, retrying on server errors
+func (a *asyncDelivery) deliver(job asyncJob) {
+	r := job.r
+	for attempt := 0; ; attempt++ {
+		rec := &resultWriter{header: http.Header{}}
+		job.handler(rec, r)
+		switch {
+		case rec.status < 300:
+			a.webhook.notify(r, rec.status)
+			return
+		case rec.status < 500 && rec.status != http.StatusTooManyRequests:
+			r.Printf("Async delivery failed permanently: %d %s", rec.status, rec.body)
+			r.stats.asyncFailed.Add(1)
+			a.webhook.notify(r, rec.status)
+			a.deadLetters.record(r, rec.status, rec.body)
+			return
+		case attempt >= a.retries:
+			r.Printf("Async delivery failed after %d retries: %d %s", attempt, rec.status, rec.body)
+			r.stats.asyncFailed.Add(1)
+			a.webhook.notify(r, rec.status)
+			a.deadLetters.record(r, rec.status, rec.body)
+			return
+		}
+		r.Debugf("Async delivery failed, retrying: %d %s", rec.status, rec.body)
+		time.Sleep(asyncRetryDelay << attempt)
+		r.retry = true
+	}
+}
+
+// resultWriter is a ResponseWriter that captures the response of a handler
+type resultWriter struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *resultWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *resultWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *resultWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// apnsBatcher groups the notifications to the same device token that arrive
+// within window, and flushes each group at once when its window is over, as
+// concurrent HTTP/2 streams over the APNs clients. This trades up to window
+// of added latency per notification for fewer, denser bursts to APNs when
+// Rocket.Chat sends several pushes to a device in quick succession. A window
+// of 0 disables batching and every notification is pushed immediately.
+type apnsBatcher struct {
+	pusher apnsPusher
+	window time.Duration
+	mu     sync.Mutex
+	// pending maps device tokens to their open batch
+	pending map[string]*apnsBatch
+}
+
+// apnsBatch is the group of notifications to a device token that is flushed
+// together
+type apnsBatch struct {
+	items []*apnsBatchItem
+}
+
+// apnsBatchItem is a queued notification, done is closed when res and err
+// are set
+type apnsBatchItem struct {
+	ctx  context.Context
+	n    *apns2.Notification
+	res  *apns2.Response
+	err  error
+	done chan struct{}
+}
+
+func newAPNSBatcher(pusher apnsPusher, window time.Duration) *apnsBatcher {
+	return &apnsBatcher{
+		pusher:  pusher,
+		window:  window,
+		pending: make(map[string]*apnsBatch),
+	}
+}
+
+// Push adds the notification to the open batch of its device token, or opens
+// a new one, and returns the result once the batch was flushed
+func (b *apnsBatcher) Push(ctx context.Context, n *apns2.Notification) (*apns2.Response, error) {
+	if b.window <= 0 {
+		return b.pusher.Push(ctx, n)
+	}
+	item := &apnsBatchItem{ctx: ctx, n: n, done: make(chan struct{})}
+	b.mu.Lock()
+	batch, ok := b.pending[n.DeviceToken]
+	if !ok {
+		batch = &apnsBatch{}
+		b.pending[n.DeviceToken] = batch
+		time.AfterFunc(b.window, func() { b.flush(n.DeviceToken, batch) })
+	}
+	batch.items = append(batch.items, item)
+	b.mu.Unlock()
+	select {
+	case <-item.done:
+		return item.res, item.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush closes the batch of token and pushes all its notifications at once
+func (b *apnsBatcher) flush(token string, batch *apnsBatch) {
+	b.mu.Lock()
+	delete(b.pending, token)
+	items := batch.items
+	b.mu.Unlock()
+	for _, item := range items {
+		go func(item *apnsBatchItem) {
+			// a notification whose request ended is dropped with the error
+			// of its context
+			if item.err = item.ctx.Err(); item.err == nil {
+				item.res, item.err = b.pusher.Push(item.ctx, item.n)
+			}
+			close(item.done)
+		}(item)
+	}
+}
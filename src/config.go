@@ -0,0 +1,632 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// Config is the configuration of the gateway, which is loaded from the
+// environment and validated once at startup
+type Config struct {
+	Addr        string
+	TLSCertFile string
+	TLSKeyFile  string
+	AuthToken   string
+	StatsFile   string
+	// InfoPage is the file with the page served on /, see loadInfoPage
+	InfoPage string
+	// PProf serves the runtime profiles on /debug/pprof/
+	PProf bool
+	// ReadTimeout limits the time to read a request including its body, so
+	// slow clients can't hold connections open
+	ReadTimeout time.Duration
+	// SendTimeout limits the time a notification send to APNs or FCM may take
+	SendTimeout  time.Duration
+	MaxBodyBytes int64
+	// StrictJSON rejects requests with unknown fields, to notice changes of
+	// the Rocket.Chat push format early
+	StrictJSON bool
+	// SuccessBody adds a JSON body describing the backend to successful
+	// responses
+	SuccessBody bool
+	// InvalidTokenStatus tells Rocket.Chat to delete the device token
+	InvalidTokenStatus int
+	DefaultSound       string
+	// DefaultBadge is the badge for notifications without one, nil means the
+	// badge is omitted
+	DefaultBadge *int
+	// BadgeOmitValue is a badge value that causes the badge to be omitted,
+	// nil if unset
+	BadgeOmitValue *int
+	// ErrorLogWindow collapses errors that repeat within it, 0 logs every
+	// error
+	ErrorLogWindow time.Duration
+	// DeadLetterFile is where finally failed notifications are recorded,
+	// main opens it into deadLetters
+	DeadLetterFile string
+	deadLetters    *deadLetterFile
+	// ResultWebhook receives the final result of every push, main starts
+	// webhook for it
+	ResultWebhook string
+	webhook       *resultWebhook
+	// HostRateLimit limits the requests per second of a Rocket.Chat host
+	// across all its clients, in addition to RCPG_RATE_LIMIT per client.
+	// HostRateBurst 0 means HostRateLimit + 1.
+	HostRateLimit float64
+	HostRateBurst int
+	// MaxConcurrency limits the concurrent backend sends, 0 means unlimited.
+	// MaxQueue sends wait for a free slot, main creates pool for them.
+	MaxConcurrency int
+	MaxQueue       int
+	pool           *sendPool
+	// ForceMessageIDOnly converts all notifications to message-id-only, so
+	// the apps always fetch the content from the server
+	ForceMessageIDOnly bool
+	// StartupCheck sends a notification to an invalid token to APNs and FCM
+	// at startup. They only reject the token after authenticating the
+	// gateway, so any other error means the credentials don't work.
+	StartupCheck bool
+	// StartupCheckFatal refuses to start if the startup check fails
+	StartupCheckFatal bool
+	// CredentialsCheckInterval is how often the credential files are checked
+	// for changes, 0 disables the check
+	CredentialsCheckInterval time.Duration
+	// TrustedProxies are the networks from which X-Forwarded-For is honored,
+	// nil means it's always trusted
+	TrustedProxies []netip.Prefix
+	// OutboundProxy is the proxy for APNs, FCM and the upstream gateway, nil
+	// means HTTPS_PROXY and NO_PROXY of the environment
+	OutboundProxy *url.URL
+	// OTelEndpoint is the OTLP endpoint the traces are exported to, nil
+	// disables tracing
+	OTelEndpoint *url.URL
+	Log          LogConfig
+	Stats        StatsConfig
+	// Async and Dedup are started by main as async and dedup, which are nil
+	// if they're disabled
+	Async   AsyncConfig
+	async   *asyncDelivery
+	Dedup   DedupConfig
+	dedup   *dedupCache
+	Filter  FilterConfig
+	APNS    APNSConfig
+	FCM     FCMConfig
+	Forward ForwardConfig
+}
+
+// LogConfig configures the logging, main applies it with setupLog
+type LogConfig struct {
+	Level int
+	JSON  bool
+	// Redact masks device tokens and omits message contents
+	Redact bool
+	// Access logs every request with latency and backend
+	Access bool
+}
+
+// StatsConfig configures the stats page and the per client limits
+type StatsConfig struct {
+	// User and Pass protect the stats page with basic auth
+	User string
+	Pass string
+	// RateLimit limits the requests per second of a client, RateBurst 0
+	// means RateLimit + 1
+	RateLimit float64
+	RateBurst int
+	// MaxEntries caps the number of tracked clients, 0 means unlimited
+	MaxEntries int
+	// InvalidTokensHistory is the number of recent invalid tokens listed on
+	// /stats/invalid-tokens
+	InvalidTokensHistory int
+}
+
+// AsyncConfig configures the async delivery, main starts async for it
+type AsyncConfig struct {
+	Enabled bool
+	Queue   int
+	Workers int
+	Retries int
+}
+
+// DedupConfig configures the deduplication of notifications, a Window of 0
+// disables it
+type DedupConfig struct {
+	Window time.Duration
+	Size   int
+}
+
+// FilterConfig configures the message of filtered notifications
+type FilterConfig struct {
+	Message string
+	// Messages maps lower case locales to localized messages
+	Messages map[string]string
+	// KeepSender keeps the sender name as title of filtered notifications
+	KeepSender bool
+}
+
+// APNSConfig configures the APNs backend
+type APNSConfig struct {
+	// Enabled is false for gateways that only serve Android, which need no
+	// certificate then
+	Enabled     bool
+	Topic       string
+	CertFile    string
+	CertPass    string
+	CertBase64  string
+	CertPEMFile string
+	KeyPEMFile  string
+	Connections int
+	BatchWindow time.Duration
+	// Topics are accepted in addition to Topic, for certificates that are
+	// valid for several apps
+	Topics []string
+	// TopicSuffixes are the accepted suffixes of the topics, see
+	// apnsTopicSuffixPushTypes
+	TopicSuffixes []string
+	// LocKeys sends the alerts of messages as localization keys with the
+	// texts as arguments, so the app shows them in the language of the user
+	LocKeys bool
+	// SkipTokenCheck sends tokens that don't look like APNs tokens anyway
+	SkipTokenCheck bool
+	// InvalidTokenReasons are the rejection reasons that make Rocket.Chat
+	// delete the device token
+	InvalidTokenReasons map[string]bool
+	// CriticalAlerts enables critical alerts, which bypass Do Not Disturb.
+	// Apple rejects them unless the app has the critical alerts entitlement.
+	CriticalAlerts bool
+	// ThreadID groups the notifications of a room in the Notification Center
+	ThreadID bool
+	// InterruptionLevel is the default interruption-level, empty means the
+	// field is omitted, which iOS treats as active. InterruptionLevels maps
+	// room types (d, c, p, ...) to their own levels.
+	InterruptionLevel  payload.EInterruptionLevel
+	InterruptionLevels map[string]payload.EInterruptionLevel
+	// Expiration is the default lifetime of a notification, a negative value
+	// means no expiration is set and APNs stores the notification
+	// indefinitely
+	Expiration time.Duration
+	// CollapseID is how the apns-collapse-id is derived: raw, hash or room,
+	// see collapseID
+	CollapseID string
+	// Priority is the apns-priority of alerts, 5 lets APNs deliver them power
+	// efficiently instead of immediately
+	Priority int
+}
+
+// FCMConfig configures the FCM backend
+type FCMConfig struct {
+	// Enabled is false for gateways that only serve iOS, which need no key
+	// then
+	Enabled bool
+	KeyFile string
+	KeyJSON string
+	// DefaultMessage is the message of notifications without text, the
+	// localized filter message if empty
+	DefaultMessage string
+	// TTL is the lifetime of a notification, nil means the FCM default
+	TTL *time.Duration
+	// NativeImage sends notifications with an image as FCM notification
+	// messages, so Android renders the image natively
+	NativeImage bool
+	// DryRun validates messages and tokens with FCM without delivering them
+	DryRun bool
+	// AnalyticsLabel tags the notifications in Firebase Analytics
+	AnalyticsLabel string
+	// CollapseByRoom collapses notifications by room instead of by sender
+	CollapseByRoom bool
+	// ChannelID is the Android notification channel of the notifications
+	ChannelID string
+	// ForwardOnMismatch forwards notifications for tokens of another
+	// Firebase project to the upstream gateway
+	ForwardOnMismatch bool
+	// KeyMap renames the keys of the FCM data payload, e.g.
+	// {"message": "body"}
+	KeyMap map[string]string
+}
+
+// ForwardConfig configures forwarding to the upstream gateway
+type ForwardConfig struct {
+	Enabled bool
+	Timeout time.Duration
+	// SingleFlight lets concurrent forwards of the same notification share
+	// one upstream request and its result
+	SingleFlight bool
+	AllowedHosts map[string]bool
+	DeniedHosts  map[string]bool
+	// DisabledDelay is how long forwarding stays disabled for a client after
+	// the upstream gateway rejected it
+	DisabledDelay time.Duration
+	client        *http.Client
+}
+
+// loadConfig loads the configuration from the environment. It reports all
+// problems at once, so they can be fixed in one go.
+func loadConfig() (*Config, error) {
+	return parseConfig(os.Getenv)
+}
+
+// parseConfig parses the configuration from the variables returned by getenv
+func parseConfig(getenv func(string) string) (*Config, error) {
+	e := &envParser{getenv: getenv}
+	cfg := &Config{
+		Addr:                     e.get("RCPG_ADDR"),
+		TLSCertFile:              e.get("RCPG_TLS_CERT_FILE"),
+		TLSKeyFile:               e.get("RCPG_TLS_KEY_FILE"),
+		AuthToken:                e.get("RCPG_AUTH_TOKEN"),
+		StatsFile:                e.get("RCPG_STATS_FILE"),
+		InfoPage:                 e.get("RCPG_INFO_PAGE"),
+		PProf:                    e.getBool("RCPG_PPROF", false),
+		ReadTimeout:              e.getDuration("RCPG_READ_TIMEOUT", defaultReadTimeout),
+		SendTimeout:              e.getDuration("RCPG_SEND_TIMEOUT", 30*time.Second),
+		MaxBodyBytes:             int64(e.getInt("RCPG_MAX_BODY_BYTES", 1<<20)),
+		StrictJSON:               e.getBool("RCPG_STRICT_JSON", false),
+		SuccessBody:              e.getBool("RCPG_SUCCESS_BODY", false),
+		InvalidTokenStatus:       e.getInt("RCPG_INVALID_TOKEN_STATUS", http.StatusNotAcceptable),
+		DefaultSound:             e.get("RCPG_DEFAULT_SOUND"),
+		DefaultBadge:             e.getBadge("RCPG_DEFAULT_BADGE", 0),
+		BadgeOmitValue:           e.getBadge("RCPG_BADGE_OMIT_VALUE", -1),
+		ErrorLogWindow:           e.getDuration("RCPG_ERROR_LOG_WINDOW", 0),
+		DeadLetterFile:           e.get("RCPG_DEADLETTER_FILE"),
+		ResultWebhook:            e.get("RCPG_RESULT_WEBHOOK"),
+		HostRateLimit:            e.getFloat("RCPG_HOST_RATE_LIMIT"),
+		HostRateBurst:            e.getInt("RCPG_HOST_RATE_BURST", 0),
+		MaxConcurrency:           e.getInt("RCPG_MAX_CONCURRENCY", 0),
+		MaxQueue:                 e.getInt("RCPG_MAX_QUEUE", defaultMaxQueue),
+		ForceMessageIDOnly:       e.getBool("RCPG_FORCE_MESSAGE_ID_ONLY", false),
+		StartupCheck:             e.getBool("RCPG_STARTUP_CHECK", false),
+		StartupCheckFatal:        e.getBool("RCPG_STARTUP_CHECK_FATAL", false),
+		CredentialsCheckInterval: e.getDuration("RCPG_CREDENTIALS_CHECK_INTERVAL", time.Minute),
+		Log: LogConfig{
+			Level:  logLevelByName(e.getChoice("RCPG_LOG_LEVEL", levelNames[levelInfo], levelNames...)),
+			JSON:   e.getChoice("RCPG_LOG_FORMAT", "text", "text", "json") == "json",
+			Redact: e.getBool("RCPG_REDACT_LOGS", false),
+			Access: e.getBool("RCPG_ACCESS_LOG", false),
+		},
+		Stats: StatsConfig{
+			User:                 e.get("RCPG_STATS_USER"),
+			Pass:                 e.get("RCPG_STATS_PASS"),
+			RateLimit:            e.getFloat("RCPG_RATE_LIMIT"),
+			RateBurst:            e.getInt("RCPG_RATE_BURST", 0),
+			MaxEntries:           e.getInt("RCPG_MAX_STATS_ENTRIES", 0),
+			InvalidTokensHistory: e.getInt("RCPG_INVALID_TOKENS_HISTORY", defaultInvalidTokensHistory),
+		},
+		Async: AsyncConfig{
+			Enabled: e.getBool("RCPG_ASYNC", false),
+			Queue:   e.getInt("RCPG_ASYNC_QUEUE", defaultAsyncQueue),
+			Workers: e.getInt("RCPG_ASYNC_WORKERS", defaultAsyncWorkers),
+			Retries: e.getInt("RCPG_ASYNC_RETRIES", defaultAsyncRetries),
+		},
+		Dedup: DedupConfig{
+			Window: e.getDuration("RCPG_DEDUP_WINDOW", 0),
+			Size:   e.getInt("RCPG_DEDUP_SIZE", defaultDedupSize),
+		},
+		Filter: FilterConfig{
+			Message:    e.get("RCPG_FILTER_MESSAGE"),
+			KeepSender: e.getBool("RCPG_FILTER_KEEP_SENDER", false),
+		},
+		APNS: APNSConfig{
+			Enabled:             e.getBool("RCPG_APNS_ENABLED", true),
+			Topic:               e.get("RCPG_APNS_TOPIC"),
+			CertFile:            e.get("RCPG_APNS_CERT_FILE"),
+			CertPass:            e.get("RCPG_APNS_CERT_PASS"),
+			CertBase64:          e.get("RCPG_APNS_CERT_BASE64"),
+			CertPEMFile:         e.get("RCPG_APNS_CERT_PEM_FILE"),
+			KeyPEMFile:          e.get("RCPG_APNS_KEY_PEM_FILE"),
+			Connections:         e.getInt("RCPG_APNS_CONNECTIONS", 1),
+			BatchWindow:         e.getDuration("RCPG_APNS_BATCH_WINDOW", 0),
+			Topics:              e.getList("RCPG_APNS_TOPICS"),
+			TopicSuffixes:       e.getList("RCPG_APNS_TOPIC_SUFFIXES"),
+			LocKeys:             e.getBool("RCPG_APNS_LOC_KEYS", false),
+			SkipTokenCheck:      e.getBool("RCPG_APNS_SKIP_TOKEN_CHECK", false),
+			InvalidTokenReasons: parseInvalidTokenReasons(e.getList("RCPG_APNS_INVALID_TOKEN_REASONS")),
+			CriticalAlerts:      e.getBool("RCPG_APNS_CRITICAL_ALERTS", false),
+			ThreadID:            e.getBool("RCPG_APNS_THREAD_ID", true),
+			Expiration:          e.getSeconds("RCPG_APNS_EXPIRATION"),
+			CollapseID:          e.getChoice("RCPG_APNS_COLLAPSE_ID", "raw", "raw", "hash", "room"),
+			Priority:            e.getInt("RCPG_APNS_PRIORITY", apns2.PriorityHigh),
+		},
+		FCM: FCMConfig{
+			Enabled:           e.getBool("RCPG_FCM_ENABLED", true),
+			KeyFile:           e.get("RCPG_FCM_KEY_FILE"),
+			KeyJSON:           e.get("RCPG_FCM_KEY_JSON"),
+			DefaultMessage:    e.get("RCPG_FCM_DEFAULT_MESSAGE"),
+			NativeImage:       e.getBool("RCPG_FCM_NATIVE_IMAGE", false),
+			DryRun:            e.getBool("RCPG_FCM_DRY_RUN", false),
+			AnalyticsLabel:    e.get("RCPG_FCM_ANALYTICS_LABEL"),
+			CollapseByRoom:    e.getChoice("RCPG_FCM_COLLAPSE_KEY", "sender", "sender", "room") == "room",
+			ChannelID:         e.get("RCPG_FCM_CHANNEL_ID"),
+			ForwardOnMismatch: e.getBool("RCPG_FCM_FORWARD_ON_MISMATCH", true),
+		},
+		Forward: ForwardConfig{
+			Enabled:       e.getBool("RCPG_FORWARD_ENABLED", true),
+			Timeout:       e.getDuration("RCPG_FORWARD_TIMEOUT", 30*time.Second),
+			SingleFlight:  e.getBool("RCPG_FORWARD_SINGLEFLIGHT", false),
+			AllowedHosts:  parseHostList(e.get("RCPG_FORWARD_ALLOWED_HOSTS")),
+			DeniedHosts:   parseHostList(e.get("RCPG_FORWARD_DENIED_HOSTS")),
+			DisabledDelay: e.getDuration("RCPG_DISABLED_DELAY", time.Hour),
+		},
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = defaultAddr
+	}
+	if e.getBool("RCPG_DEBUG", false) {
+		cfg.Log.Level = levelDebug
+	}
+	if cfg.Filter.Message == "" {
+		cfg.Filter.Message = defaultFilterMessage
+	}
+	if e.get("RCPG_FCM_TTL") != "" {
+		ttl := time.Duration(e.getInt("RCPG_FCM_TTL", 0)) * time.Second
+		cfg.FCM.TTL = &ttl
+	}
+	cfg.Forward.client = &http.Client{Timeout: cfg.Forward.Timeout}
+
+	var err error
+	cfg.APNS.InterruptionLevel, cfg.APNS.InterruptionLevels, err = parseInterruptionLevels(
+		e.get("RCPG_APNS_INTERRUPTION_LEVEL"), e.get("RCPG_APNS_INTERRUPTION_LEVELS"))
+	e.check(err)
+	cfg.TrustedProxies, err = parseTrustedProxies(e.get("RCPG_TRUSTED_PROXIES"))
+	e.check(err)
+	cfg.OutboundProxy, err = parseOutboundProxy(e.get("RCPG_OUTBOUND_PROXY"))
+	e.check(err)
+	cfg.OTelEndpoint, err = parseOTelEndpoint(e.get("RCPG_OTEL_ENDPOINT"))
+	e.check(err)
+	cfg.Filter.Messages, err = loadFilterMessages(e.get("RCPG_FILTER_MESSAGES_FILE"))
+	e.check(err)
+	cfg.FCM.KeyMap, err = loadFCMKeyMap(e.get("RCPG_FCM_KEY_MAP"))
+	e.check(err)
+
+	errs := e.errs
+	if err := validateAddr(cfg.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid RCPG_ADDR %q: %w", cfg.Addr, err))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("both RCPG_TLS_CERT_FILE and RCPG_TLS_KEY_FILE must be set to enable TLS"))
+	}
+	if !cfg.APNS.Enabled && !cfg.FCM.Enabled {
+		errs = append(errs, errors.New("RCPG_APNS_ENABLED and RCPG_FCM_ENABLED must not both be false"))
+	}
+	if cfg.APNS.Enabled {
+		errs = append(errs, cfg.APNS.validate()...)
+	}
+	if cfg.FCM.Enabled && cfg.FCM.KeyFile == "" && cfg.FCM.KeyJSON == "" {
+		errs = append(errs, errors.New("RCPG_FCM_KEY_FILE or RCPG_FCM_KEY_JSON must be set"))
+	}
+	if cfg.ReadTimeout < 0 {
+		errs = append(errs, errors.New("RCPG_READ_TIMEOUT must not be negative"))
+	}
+	if cfg.SendTimeout <= 0 {
+		errs = append(errs, errors.New("RCPG_SEND_TIMEOUT must be positive"))
+	}
+	if cfg.MaxBodyBytes == 0 {
+		errs = append(errs, errors.New("RCPG_MAX_BODY_BYTES must be positive"))
+	}
+	if cfg.InvalidTokenStatus < 400 || cfg.InvalidTokenStatus > 499 {
+		errs = append(errs, errors.New("RCPG_INVALID_TOKEN_STATUS must be a 4xx status code"))
+	}
+	if cfg.ErrorLogWindow < 0 {
+		errs = append(errs, errors.New("RCPG_ERROR_LOG_WINDOW must not be negative"))
+	}
+	if cfg.Forward.Timeout <= 0 {
+		errs = append(errs, errors.New("RCPG_FORWARD_TIMEOUT must be positive"))
+	}
+	if cfg.Forward.DisabledDelay <= 0 {
+		errs = append(errs, errors.New("RCPG_DISABLED_DELAY must be positive"))
+	}
+	if cfg.HostRateBurst > 0 && cfg.HostRateLimit == 0 {
+		errs = append(errs, errors.New("RCPG_HOST_RATE_BURST requires RCPG_HOST_RATE_LIMIT"))
+	}
+	if cfg.Dedup.Window > 0 && cfg.Dedup.Size == 0 {
+		errs = append(errs, errors.New("RCPG_DEDUP_SIZE must be positive"))
+	}
+	if cfg.StartupCheckFatal && !cfg.StartupCheck {
+		errs = append(errs, errors.New("RCPG_STARTUP_CHECK_FATAL requires RCPG_STARTUP_CHECK"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func (c *APNSConfig) validate() []error {
+	var errs []error
+	switch {
+	case c.CertBase64 != "":
+	case c.CertPEMFile != "" || c.KeyPEMFile != "":
+		if c.CertPEMFile == "" || c.KeyPEMFile == "" {
+			errs = append(errs, errors.New("both RCPG_APNS_CERT_PEM_FILE and RCPG_APNS_KEY_PEM_FILE must be set"))
+		}
+	case c.CertFile == "":
+		errs = append(errs, errors.New("RCPG_APNS_CERT_FILE, RCPG_APNS_CERT_BASE64 or RCPG_APNS_CERT_PEM_FILE must be set"))
+	}
+	if c.BatchWindow < 0 {
+		errs = append(errs, errors.New("RCPG_APNS_BATCH_WINDOW must not be negative"))
+	}
+	if c.Priority != apns2.PriorityLow && c.Priority != apns2.PriorityHigh {
+		errs = append(errs, errors.New("RCPG_APNS_PRIORITY must be 5 or 10"))
+	}
+	for _, suffix := range c.TopicSuffixes {
+		if _, ok := apnsTopicSuffixPushTypes[suffix]; !ok {
+			errs = append(errs, fmt.Errorf("unsupported suffix %q in RCPG_APNS_TOPIC_SUFFIXES", suffix))
+		}
+	}
+	return errs
+}
+
+// topics returns all accepted topics without suffixes
+func (c *APNSConfig) topics() []string {
+	if c.Topic == "" {
+		return c.Topics
+	}
+	return append([]string{c.Topic}, c.Topics...)
+}
+
+// certFiles returns the files the APNs certificate is loaded from
+func (c *APNSConfig) certFiles() []string {
+	switch {
+	case c.CertBase64 != "":
+		return nil
+	case c.CertPEMFile != "" || c.KeyPEMFile != "":
+		return []string{c.CertPEMFile, c.KeyPEMFile}
+	}
+	return []string{c.CertFile}
+}
+
+// envParser parses environment variables and collects the invalid ones, so
+// parseConfig can report them along with its own errors
+type envParser struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (e *envParser) get(name string) string {
+	return e.getenv(name)
+}
+
+// invalid records that the environment variable name is invalid
+func (e *envParser) invalid(name, format string, v ...any) {
+	e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %s", name, e.get(name), fmt.Sprintf(format, v...)))
+}
+
+// check records err, if it's not nil
+func (e *envParser) check(err error) {
+	if err != nil {
+		e.errs = append(e.errs, err)
+	}
+}
+
+// getInt parses the environment variable name as a non-negative integer,
+// returning def if it's unset or invalid
+func (e *envParser) getInt(name string, def int) int {
+	s := e.get(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		e.invalid(name, "must be a non-negative integer")
+		return def
+	}
+	return n
+}
+
+// getFloat parses the environment variable name as a non-negative number,
+// returning 0 if it's unset or invalid
+func (e *envParser) getFloat(name string) float64 {
+	s := e.get(name)
+	if s == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		e.invalid(name, "must be a non-negative number")
+		return 0
+	}
+	return f
+}
+
+// getBool parses the environment variable name as a boolean, returning def
+// if it's unset or invalid
+func (e *envParser) getBool(name string, def bool) bool {
+	s := e.get(name)
+	if s == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		e.invalid(name, "must be true or false")
+		return def
+	}
+	return b
+}
+
+// getDuration parses the environment variable name as a duration, returning
+// def if it's unset or invalid
+func (e *envParser) getDuration(name string, def time.Duration) time.Duration {
+	s := e.get(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		e.invalid(name, "must be a duration like 30s")
+		return def
+	}
+	return d
+}
+
+// getSeconds parses the environment variable name as a number of seconds,
+// returning -1 if it's unset, invalid or negative
+func (e *envParser) getSeconds(name string) time.Duration {
+	s := e.get(name)
+	if s == "" {
+		return -1
+	}
+	secs, err := strconv.Atoi(s)
+	if err != nil {
+		e.invalid(name, "must be an integer number of seconds")
+		return -1
+	}
+	if secs < 0 {
+		return -1
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// getBadge parses the environment variable name as a badge, where "none"
+// and unset with a negative def are nil
+func (e *envParser) getBadge(name string, def int) *int {
+	s := e.get(name)
+	switch {
+	case s == "none":
+		return nil
+	case s == "" && def < 0:
+		return nil
+	case s == "":
+		return &def
+	}
+	badge, err := strconv.Atoi(s)
+	if err != nil {
+		e.invalid(name, "must be an integer")
+		return nil
+	}
+	return &badge
+}
+
+// getChoice returns the value of the environment variable name, which must
+// be one of choices, or def if it's unset or invalid
+func (e *envParser) getChoice(name, def string, choices ...string) string {
+	s := e.get(name)
+	if s == "" {
+		return def
+	}
+	for _, choice := range choices {
+		if strings.EqualFold(s, choice) {
+			return choice
+		}
+	}
+	e.invalid(name, "must be %s or %s", strings.Join(choices[:len(choices)-1], ", "), choices[len(choices)-1])
+	return def
+}
+
+// getList splits the environment variable name at commas, omitting empty
+// elements
+func (e *envParser) getList(name string) []string {
+	var list []string
+	for _, s := range strings.Split(e.get(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// configInfo is the effective configuration served on /config, to verify
+// which settings a running gateway loaded. It must not contain secrets, so
+// passwords, tokens, certificates and keys are only reported as set, and URLs
+// only with scheme and host.
+type configInfo struct {
+	Addr           string      `json:"addr"`
+	TLS            bool        `json:"tls"`
+	AuthToken      bool        `json:"authToken"`
+	StatsAuth      bool        `json:"statsAuth"`
+	StatsFile      string      `json:"statsFile,omitempty"`
+	ReadTimeout    string      `json:"readTimeout"`
+	SendTimeout    string      `json:"sendTimeout"`
+	RateLimit      float64     `json:"rateLimit,omitempty"`
+	HostRateLimit  float64     `json:"hostRateLimit,omitempty"`
+	Async          bool        `json:"async"`
+	ResultWebhook  string      `json:"resultWebhook,omitempty"`
+	DeadLetterFile string      `json:"deadLetterFile,omitempty"`
+	OutboundProxy  string      `json:"outboundProxy,omitempty"`
+	OTelEndpoint   string      `json:"otelEndpoint,omitempty"`
+	APNS           apnsInfo    `json:"apns"`
+	FCM            fcmInfo     `json:"fcm"`
+	Forward        forwardInfo `json:"forward"`
+	Filter         filterInfo  `json:"filter"`
+}
+
+type apnsInfo struct {
+	Enabled       bool     `json:"enabled"`
+	Topics        []string `json:"topics"`
+	TopicSuffixes []string `json:"topicSuffixes,omitempty"`
+	CertFiles     []string `json:"certFiles,omitempty"`
+	CertBase64    bool     `json:"certBase64"`
+	Connections   int      `json:"connections"`
+	BatchWindow   string   `json:"batchWindow"`
+	Priority      int      `json:"priority"`
+	CollapseID    string   `json:"collapseId"`
+	LocKeys       bool     `json:"locKeys"`
+}
+
+type fcmInfo struct {
+	Enabled     bool   `json:"enabled"`
+	KeyFile     string `json:"keyFile,omitempty"`
+	KeyJSON     bool   `json:"keyJson"`
+	DryRun      bool   `json:"dryRun"`
+	CollapseKey string `json:"collapseKey"`
+	ChannelID   string `json:"channelId,omitempty"`
+}
+
+type forwardInfo struct {
+	Enabled      bool     `json:"enabled"`
+	Upstream     string   `json:"upstream"`
+	Timeout      string   `json:"timeout"`
+	SingleFlight bool     `json:"singleFlight"`
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	DeniedHosts  []string `json:"deniedHosts,omitempty"`
+}
+
+type filterInfo struct {
+	Message            string   `json:"message"`
+	Locales            []string `json:"locales,omitempty"`
+	KeepSender         bool     `json:"keepSender"`
+	ForceMessageIDOnly bool     `json:"forceMessageIdOnly"`
+}
+
+func getConfigInfo(cfg *Config) configInfo {
+	info := configInfo{
+		Addr:           cfg.Addr,
+		TLS:            cfg.TLSCertFile != "",
+		AuthToken:      cfg.AuthToken != "",
+		StatsAuth:      cfg.Stats.User != "" || cfg.Stats.Pass != "",
+		StatsFile:      cfg.StatsFile,
+		ReadTimeout:    cfg.ReadTimeout.String(),
+		SendTimeout:    cfg.SendTimeout.String(),
+		RateLimit:      cfg.Stats.RateLimit,
+		HostRateLimit:  cfg.HostRateLimit,
+		Async:          cfg.Async.Enabled,
+		ResultWebhook:  urlHost(cfg.ResultWebhook),
+		DeadLetterFile: cfg.DeadLetterFile,
+		APNS: apnsInfo{
+			Enabled:       cfg.APNS.Enabled,
+			Topics:        cfg.APNS.topics(),
+			TopicSuffixes: cfg.APNS.TopicSuffixes,
+			CertFiles:     cfg.APNS.certFiles(),
+			CertBase64:    cfg.APNS.CertBase64 != "",
+			Connections:   cfg.APNS.Connections,
+			BatchWindow:   cfg.APNS.BatchWindow.String(),
+			Priority:      cfg.APNS.Priority,
+			CollapseID:    cfg.APNS.CollapseID,
+			LocKeys:       cfg.APNS.LocKeys,
+		},
+		FCM: fcmInfo{
+			Enabled:     cfg.FCM.Enabled,
+			KeyFile:     cfg.FCM.KeyFile,
+			KeyJSON:     cfg.FCM.KeyJSON != "",
+			DryRun:      cfg.FCM.DryRun,
+			CollapseKey: "sender",
+			ChannelID:   cfg.FCM.ChannelID,
+		},
+		Forward: forwardInfo{
+			Enabled:      cfg.Forward.Enabled,
+			Upstream:     upstreamGateway,
+			Timeout:      cfg.Forward.Timeout.String(),
+			SingleFlight: cfg.Forward.SingleFlight,
+			AllowedHosts: sortedKeys(cfg.Forward.AllowedHosts),
+			DeniedHosts:  sortedKeys(cfg.Forward.DeniedHosts),
+		},
+		Filter: filterInfo{
+			Message:            cfg.Filter.Message,
+			KeepSender:         cfg.Filter.KeepSender,
+			ForceMessageIDOnly: cfg.ForceMessageIDOnly,
+		},
+	}
+	if cfg.OutboundProxy != nil {
+		info.OutboundProxy = urlHost(cfg.OutboundProxy.String())
+	}
+	if cfg.OTelEndpoint != nil {
+		info.OTelEndpoint = urlHost(cfg.OTelEndpoint.String())
+	}
+	if info.APNS.CertBase64 {
+		info.APNS.CertFiles = nil
+	}
+	if cfg.FCM.CollapseByRoom {
+		info.FCM.CollapseKey = "room"
+	}
+	for locale := range cfg.Filter.Messages {
+		info.Filter.Locales = append(info.Filter.Locales, locale)
+	}
+	sort.Strings(info.Filter.Locales)
+	return info
+}
+
+// urlHost returns only the scheme and host of rawURL, the rest can contain
+// credentials
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configHandler serves the effective configuration without secrets
+func configHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("ConfigHandler for %s from %s", r.RequestURI, getIP(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getConfigInfo(cfg))
+	}
+}
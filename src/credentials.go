@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileStates describes the size and modification time of files, so changes
+// can be detected by comparing the results
+func fileStates(files []string) string {
+	var b strings.Builder
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %v\n", file, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %d %s\n", file, fi.Size(), fi.ModTime())
+	}
+	return b.String()
+}
+
+// watchCredentials checks the credential files of name every interval and
+// calls reload when they changed, so rotated credentials take effect without
+// a restart. If reload fails, the old credentials stay in use.
+func watchCredentials(interval time.Duration, name string, files []string, reload func() error) {
+	if interval <= 0 || len(files) == 0 {
+		return
+	}
+	go func() {
+		last := fileStates(files)
+		for range time.Tick(interval) {
+			current := fileStates(files)
+			if current == last {
+				continue
+			}
+			last = current
+			if err := reload(); err != nil {
+				log.Printf("Failed to reload %s, keeping the old ones: %v", name, err)
+				continue
+			}
+			log.Printf("Reloaded %s", name)
+		}
+	}()
+}
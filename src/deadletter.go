@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	deadLetterQueue = 1000
+	// maxDeadLetterError limits the error recorded from the response body
+	maxDeadLetterError = 1024
+)
+
+// deadLetterFile appends every notification that finally failed to
+// RCPG_DEADLETTER_FILE as JSON lines, for investigating or replaying them
+// later. Writing happens in the background, so a slow disk doesn't stall the
+// requests.
+type deadLetterFile struct {
+	f        *os.File
+	queue    chan deadLetter
+	logLimit *rate.Limiter
+	pending  pendingWork
+}
+
+type deadLetter struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Backend   string    `json:"backend,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	UniqueID  string    `json:"uniqueId,omitempty"`
+	MessageID string    `json:"messageId,omitempty"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// openDeadLetterFile opens file for appending and starts the writer
+func openDeadLetterFile(file string) (*deadLetterFile, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	d := &deadLetterFile{
+		f:        f,
+		queue:    make(chan deadLetter, deadLetterQueue),
+		logLimit: rate.NewLimiter(rate.Every(time.Minute), 1),
+	}
+	go d.worker()
+	return d, nil
+}
+
+// record queues r for the file if its final status is a failure, d may be nil
+// if RCPG_DEADLETTER_FILE is unset. Invalid
+// tokens aren't failures, Rocket.Chat deletes them.
+func (d *deadLetterFile) record(r *rcRequest, status int, body []byte) {
+	if d == nil || status < 300 || r.tokenDeleted {
+		return
+	}
+	l := deadLetter{
+		Time:      time.Now(),
+		RequestID: r.requestID,
+		Backend:   r.backend,
+		Host:      r.host,
+		UniqueID:  r.data.Options.UniqueID,
+		Status:    status,
+		Error:     r.redact(responseError(body)),
+	}
+	if r.data.Token != "" {
+		l.Token = redactToken(r.data.Token)
+	}
+	if pl := r.data.Options.Payload; pl != nil {
+		l.MessageID = pl.MessageID
+	}
+	d.pending.add()
+	select {
+	case d.queue <- l:
+	default:
+		d.pending.done()
+		d.logf("Dead-letter queue is full, dropping notification %s", r.requestID)
+	}
+}
+
+func (d *deadLetterFile) worker() {
+	for l := range d.queue {
+		b, _ := json.Marshal(l)
+		if _, err := d.f.Write(append(b, '\n')); err != nil {
+			d.logf("Failed to write dead-letter file: %v", err)
+		}
+		d.pending.done()
+	}
+}
+
+// logf logs problems with the file, but at most once per minute
+func (d *deadLetterFile) logf(s string, v ...any) {
+	if d.logLimit.Allow() {
+		log.Printf(s, v...)
+	}
+}
+
+// responseError returns the error of an error response written by
+// writeError, or the body itself for other responses, e.g. of the upstream
+// gateway
+func responseError(body []byte) string {
+	var e errorResponse
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		if e.Reason != "" {
+			return e.Reason + ": " + e.Error
+		}
+		return e.Error
+	}
+	if len(body) > maxDeadLetterError {
+		body = body[:maxDeadLetterError]
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const defaultDedupSize = 10000
+
+// dedupCache remembers recently seen notifications for window, holding at
+// most size entries, the oldest are evicted first
+type dedupCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// newDedupCache creates the cache from RCPG_DEDUP_WINDOW and RCPG_DEDUP_SIZE
+func newDedupCache(c DedupConfig) *dedupCache {
+	return &dedupCache{
+		window:  c.Window,
+		size:    c.Size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// seen reports whether key was seen within the window, otherwise it records
+// the key as seen now
+func (c *dedupCache) seen(key string) bool {
+	if c == nil {
+		return false
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// drop expired entries, the list is ordered by time
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(*dedupEntry).seen) < c.window {
+			break
+		}
+		c.remove(e)
+	}
+	if _, ok := c.entries[key]; ok {
+		return true
+	}
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Front())
+	}
+	c.entries[key] = c.order.PushBack(&dedupEntry{key: key, seen: now})
+	return false
+}
+
+// forget removes key, so a failed notification can be retried
+func (c *dedupCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *dedupCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*dedupEntry).key)
+	c.order.Remove(e)
+}
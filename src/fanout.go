@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type fanOutResult struct {
+	Sent bool `json:"sent"`
+	// Invalid is set if the token of the platform has to be deleted
+	Invalid bool            `json:"invalid,omitempty"`
+	Status  int             `json:"status"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	backend string
+}
+
+// getFanOutHandler returns the handler for /push/send, which sends the
+// notification to the APNs token and the FCM token of the request, or to the
+// token on the platform given as hint, and aggregates the results. If some
+// platforms succeed while others reject their token, the response is a success
+// and the rejected tokens are marked as invalid in the results.
+func getFanOutHandler(handlers map[string]func(http.ResponseWriter, *rcRequest)) func(http.ResponseWriter, *rcRequest) {
+	return func(w http.ResponseWriter, r *rcRequest) {
+		tokens := map[string]string{}
+		if r.data.APNToken != "" {
+			tokens["apn"] = r.data.APNToken
+		}
+		if r.data.GCMToken != "" {
+			tokens["gcm"] = r.data.GCMToken
+		}
+		if r.data.Platform != "" {
+			if _, ok := handlers[r.data.Platform]; !ok {
+				r.Errorf("Unknown platform: %s", r.data.Platform)
+				writeError(w, http.StatusBadRequest, "UnknownPlatform", "unknown platform: "+r.data.Platform)
+				return
+			}
+			if r.data.Token != "" {
+				tokens[r.data.Platform] = r.data.Token
+			}
+		}
+		if len(tokens) == 0 {
+			r.Errorf("No platform token")
+			writeError(w, http.StatusBadRequest, "MissingField", "missing field: apnToken, gcmToken or platform")
+			return
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		results := make(map[string]fanOutResult, len(tokens))
+		for platform, token := range tokens {
+			// every platform gets its own copy of the request, as the
+			// handlers modify it when forwarding
+			pr := &rcRequest{}
+			*pr = *r
+			pr.data.Token = token
+			pr.data.Platform, pr.data.APNToken, pr.data.GCMToken = "", "", ""
+			// forwarding has to rebuild the body for the platform token
+			pr.body = nil
+			pr.http = r.http.Clone(r.http.Context())
+			pr.http.URL.Path = platformRoutes[platform]
+			wg.Add(1)
+			go func(platform string, handler func(http.ResponseWriter, *rcRequest)) {
+				defer wg.Done()
+				rec := &resultWriter{header: http.Header{}}
+				handler(rec, pr)
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				res := fanOutResult{
+					Sent:    rec.status < 300,
+					Invalid: pr.tokenDeleted,
+					Status:  rec.status,
+					backend: pr.backend,
+				}
+				if json.Valid(rec.body) {
+					res.Result = rec.body
+				}
+				mu.Lock()
+				results[platform] = res
+				mu.Unlock()
+			}(platform, handlers[platform])
+		}
+		wg.Wait()
+
+		platforms := make([]string, 0, len(results))
+		for platform := range results {
+			platforms = append(platforms, platform)
+		}
+		sort.Strings(platforms)
+		backends := make([]string, len(platforms))
+		// succeed if any platform succeeded, otherwise report the failure.
+		// The token is deleted if no platform failed for another reason.
+		status, deleted, failed := 0, 0, 0
+		for i, platform := range platforms {
+			res := results[platform]
+			backends[i] = res.backend
+			switch {
+			case res.Sent:
+				status = http.StatusOK
+			case res.Invalid:
+				deleted++
+			default:
+				failed++
+			}
+			if status != http.StatusOK && res.Status > status {
+				status = res.Status
+			}
+		}
+		r.backend = strings.Join(backends, ",")
+		r.tokenDeleted = deleted > 0 && failed == 0
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+		r.Printf("Fan-out notification sent: %+v", results)
+	}
+}
@@ -7,73 +7,359 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync/atomic"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/option"
 )
 
-func getGCMPushNotificationHandler() func(http.ResponseWriter, *rcRequest) {
-	opt := option.WithCredentialsFile(os.Getenv("RCPG_FCM_KEY_FILE"))
+// getFCMPriority returns "normal" for silent data-only notifications, which
+// don't need to wake the device immediately, and "high" otherwise
+func getFCMPriority(pl *RCPayload) string {
+	if pl != nil && pl.NotificationType == "message-id-only" {
+		return "normal"
+	}
+	return "high"
+}
+
+// collapseKey returns the collapse key, which is the room with
+// RCPG_FCM_COLLAPSE_KEY=room and the sender otherwise
+func (c *FCMConfig) collapseKey(from string, pl *RCPayload) string {
+	if c.CollapseByRoom && pl != nil && pl.Rid != "" {
+		return pl.Rid
+	}
+	return from
+}
+
+// getTitleAndMessage returns the title and message of the notification. The
+// app displays them as they are, so empty ones fall back to the sender or the
+// host of the server, and to the default message of RCPG_FCM_DEFAULT_MESSAGE
+// or the filter message.
+func (r *rcRequest) getTitleAndMessage(cfg *Config) (string, string) {
+	opt := &r.data.Options
+	title, message := opt.Title, opt.Text
+	if title == "" && opt.Payload != nil {
+		title = senderName(opt.Payload)
+		if title == "" {
+			title = hostName(opt.Payload.Host)
+		}
+	}
+	if message == "" {
+		message = cfg.FCM.DefaultMessage
+		if message == "" {
+			message = cfg.Filter.message(opt.Locale)
+		}
+	}
+	return title, message
+}
+
+// loadFCMKeyMap loads the optional JSON object from file that renames the
+// keys of the FCM data payload, e.g. {"message": "body"}
+func loadFCMKeyMap(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keyMap map[string]string
+	if err := json.Unmarshal(data, &keyMap); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	return keyMap, nil
+}
+
+// mapKeys renames the keys of data according to keyMap
+func mapKeys(data map[string]string, keyMap map[string]string) map[string]string {
+	if len(keyMap) == 0 {
+		return data
+	}
+	mapped := make(map[string]string, len(data))
+	for k, v := range data {
+		if newKey, ok := keyMap[k]; ok {
+			k = newKey
+		}
+		mapped[k] = v
+	}
+	return mapped
+}
+
+// newFCMClient creates the FCM client with the inline credentials if set,
+// and from the key file otherwise
+func newFCMClient(cfg *FCMConfig) (*messaging.Client, error) {
+	var opt option.ClientOption
+	if cfg.KeyJSON != "" {
+		log.Println("Using FCM credentials from RCPG_FCM_KEY_JSON")
+		opt = option.WithCredentialsJSON([]byte(cfg.KeyJSON))
+	} else {
+		log.Println("Using FCM credentials from RCPG_FCM_KEY_FILE")
+		opt = option.WithCredentialsFile(cfg.KeyFile)
+	}
 	app, err := firebase.NewApp(context.Background(), nil, opt)
 	if err != nil {
-		log.Fatalf("error initializing app: %v", err)
+		return nil, fmt.Errorf("error initializing app: %w", err)
 	}
 	client, err := app.Messaging(context.Background())
 	if err != nil {
-		log.Fatalf("error initializing FCM client: %v", err)
+		return nil, fmt.Errorf("error initializing FCM client: %w", err)
+	}
+	return client, nil
+}
+
+func getGCMPushNotificationHandler(cfg *Config) func(http.ResponseWriter, *rcRequest) {
+	c, err := newFCMClient(&cfg.FCM)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &reloadableFCMClient{}
+	client.Store(c)
+	if cfg.StartupCheck {
+		reportStartupCheck("FCM", checkFCM(client), cfg.StartupCheckFatal)
+	}
+	if cfg.FCM.KeyJSON == "" {
+		watchCredentials(cfg.CredentialsCheckInterval, "FCM credentials", []string{cfg.FCM.KeyFile}, func() error {
+			c, err := newFCMClient(&cfg.FCM)
+			if err != nil {
+				return err
+			}
+			client.Store(c)
+			return nil
+		})
 	}
+	if cfg.FCM.DryRun {
+		log.Println("FCM dry-run mode is active, notifications are not delivered")
+	}
+	return newGCMHandler(cfg, client)
+}
+
+// fcmSender sends messages to FCM, it's implemented by messaging.Client
+type fcmSender interface {
+	Send(ctx context.Context, msg *messaging.Message) (string, error)
+	SendDryRun(ctx context.Context, msg *messaging.Message) (string, error)
+	SendEachForMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+	SendEachForMulticastDryRun(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+}
+
+// reloadableFCMClient is an fcmSender whose client can be replaced while it's
+// in use
+type reloadableFCMClient struct {
+	atomic.Pointer[messaging.Client]
+}
+
+func (c *reloadableFCMClient) Send(ctx context.Context, msg *messaging.Message) (string, error) {
+	return c.Load().Send(ctx, msg)
+}
+
+func (c *reloadableFCMClient) SendDryRun(ctx context.Context, msg *messaging.Message) (string, error) {
+	return c.Load().SendDryRun(ctx, msg)
+}
 
+func (c *reloadableFCMClient) SendEachForMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return c.Load().SendEachForMulticast(ctx, msg)
+}
+
+func (c *reloadableFCMClient) SendEachForMulticastDryRun(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return c.Load().SendEachForMulticastDryRun(ctx, msg)
+}
+
+// newGCMHandler returns the handler that sends the notifications with client
+func newGCMHandler(cfg *Config, client fcmSender) func(http.ResponseWriter, *rcRequest) {
 	return func(w http.ResponseWriter, r *rcRequest) {
-		r.stats.fcm.Add(1)
+		if !r.retry {
+			r.stats.fcm.Add(1)
+		}
+		r.backend = "fcm"
 
-		opt := r.data.Options
+		opt := &r.data.Options
+		title, message := r.getTitleAndMessage(cfg)
 
 		data := map[string]string{
 			"ejson":   string(r.ejson),
-			"title":   opt.Title,
-			"message": opt.Text,
-			"msgcnt":  fmt.Sprint(opt.Badge),
-			"sound":   opt.Sound,
+			"title":   title,
+			"message": message,
+			"sound":   r.getSound(cfg),
 			"notId":   fmt.Sprint(opt.NotID),
 			"image":   "",
 			"style":   "",
 		}
 
+		if badge, ok := r.getBadge(cfg); ok {
+			data["msgcnt"] = fmt.Sprint(badge)
+		}
+
 		if opt.Gcm != nil {
 			data["image"] = opt.Gcm.Image
 			data["style"] = opt.Gcm.Style
 		}
 
+		android := &messaging.AndroidConfig{
+			CollapseKey: cfg.FCM.collapseKey(opt.From, opt.Payload),
+			Priority:    getFCMPriority(opt.Payload),
+			TTL:         cfg.FCM.TTL,
+			Data:        mapKeys(data, cfg.FCM.KeyMap),
+		}
+		if cfg.FCM.AnalyticsLabel != "" {
+			android.FCMOptions = &messaging.AndroidFCMOptions{AnalyticsLabel: cfg.FCM.AnalyticsLabel}
+		}
+
+		var notification *messaging.Notification
+		if cfg.FCM.NativeImage && opt.Gcm != nil && opt.Gcm.Image != "" {
+			notification = &messaging.Notification{
+				Title:    title,
+				Body:     message,
+				ImageURL: opt.Gcm.Image,
+			}
+			android.Notification = &messaging.AndroidNotification{
+				ImageURL: opt.Gcm.Image,
+			}
+		}
+		if cfg.FCM.ChannelID != "" && !r.isMessageIDOnly() {
+			if android.Notification == nil {
+				android.Notification = &messaging.AndroidNotification{
+					Title: title,
+					Body:  message,
+				}
+			}
+			android.Notification.ChannelID = cfg.FCM.ChannelID
+		}
+
+		if len(opt.Tokens) > 0 {
+			sendMulticast(w, r, cfg, client, &messaging.MulticastMessage{
+				Tokens:       opt.Tokens,
+				Notification: notification,
+				Android:      android,
+			})
+			return
+		}
+
 		msg := &messaging.Message{
-			Token: r.data.Token,
-			Android: &messaging.AndroidConfig{
-				CollapseKey: opt.From,
-				Priority:    "high",
-				Data:        data,
-			},
+			Token:        r.data.Token,
+			Notification: notification,
+			Android:      android,
 		}
 
 		msgJSON, _ := json.Marshal(msg)
 		r.Debugf("Sending notification: %s", msgJSON)
 
-		_, err := client.Send(context.Background(), msg)
+		ctx, cancel := r.sendContext(cfg)
+		if !r.acquireSend(ctx, w, cfg.pool) {
+			cancel()
+			return
+		}
+		ctx, span := startBackendSpan(ctx, "fcm.send", "fcm")
+		var msgID string
+		var err error
+		if cfg.FCM.DryRun {
+			r.Printf("Dry-run: validating notification without delivery")
+			msgID, err = client.SendDryRun(ctx, msg)
+		} else {
+			msgID, err = client.Send(ctx, msg)
+		}
+		endSpan(span, err)
+		cancel()
+		cfg.pool.release()
 		if err != nil {
 			if messaging.IsUnregistered(err) {
 				r.Printf("Deleting invalid token: %s", r.data.Token)
-				w.WriteHeader(http.StatusNotAcceptable)
+				r.invalidToken(r.data.Token, "fcm", "Unregistered")
+				r.tokenDeleted = true
+				writeError(w, cfg.InvalidTokenStatus, "Unregistered", "invalid device token")
 				return
 			}
-			if messaging.IsSenderIDMismatch(err) {
-				forward(w, r)
+			// forward reports disabled forwarding itself
+			if messaging.IsSenderIDMismatch(err) && cfg.FCM.ForwardOnMismatch {
+				forward(w, r, cfg, "gcm")
 				return
 			}
 			r.Errorf("error sending FCM msg: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "SendFailed", err.Error())
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		cfg.writeSuccess(w, successResponse{Backend: "fcm", Sent: true, MessageID: msgID})
 		r.Printf("Notification sent to FCM")
 	}
 }
+
+type multicastResult struct {
+	Token     string `json:"token"`
+	Sent      bool   `json:"sent"`
+	Invalid   bool   `json:"invalid,omitempty"`
+	Error     string `json:"error,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+}
+
+// sendMulticast delivers the notification to multiple tokens in one call and
+// reports the result per token. It responds with the invalid token status
+// only if all tokens are invalid, otherwise Rocket.Chat has to delete the
+// tokens marked as invalid in the response body individually.
+func sendMulticast(w http.ResponseWriter, r *rcRequest, cfg *Config, client fcmSender, msg *messaging.MulticastMessage) {
+	msgJSON, _ := json.Marshal(msg)
+	r.Debugf("Sending multicast notification: %s", msgJSON)
+
+	ctx, cancel := r.sendContext(cfg)
+	if !r.acquireSend(ctx, w, cfg.pool) {
+		cancel()
+		return
+	}
+	ctx, span := startBackendSpan(ctx, "fcm.multicast", "fcm")
+	var br *messaging.BatchResponse
+	var err error
+	if cfg.FCM.DryRun {
+		r.Printf("Dry-run: validating multicast notification without delivery")
+		br, err = client.SendEachForMulticastDryRun(ctx, msg)
+	} else {
+		br, err = client.SendEachForMulticast(ctx, msg)
+	}
+	if br != nil {
+		span.SetAttributes(attribute.Int("fcm.success_count", br.SuccessCount), attribute.Int("fcm.failure_count", br.FailureCount))
+	}
+	endSpan(span, err)
+	cancel()
+	cfg.pool.release()
+	if err != nil {
+		r.Errorf("error sending FCM multicast msg: %v", err)
+		writeError(w, http.StatusBadRequest, "SendFailed", err.Error())
+		return
+	}
+
+	results := make([]multicastResult, len(br.Responses))
+	invalid := 0
+	for i, resp := range br.Responses {
+		results[i] = multicastResult{
+			Token:     msg.Tokens[i],
+			Sent:      resp.Success,
+			MessageID: resp.MessageID,
+		}
+		if resp.Error == nil {
+			continue
+		}
+		results[i].Error = resp.Error.Error()
+		if messaging.IsUnregistered(resp.Error) {
+			r.Printf("Deleting invalid token: %s", msg.Tokens[i])
+			r.invalidToken(msg.Tokens[i], "fcm", "Unregistered")
+			results[i].Invalid = true
+			invalid++
+		} else {
+			r.Printf("Failed to send to token %s: %v", msg.Tokens[i], resp.Error)
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case invalid == len(results):
+		status = cfg.InvalidTokenStatus
+		r.tokenDeleted = true
+	case br.SuccessCount == 0:
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+	r.Printf("Multicast notification sent to FCM: %d sent, %d failed",
+		br.SuccessCount, br.FailureCount)
+}
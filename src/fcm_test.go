@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/option"
+)
+
+// newTestFCMClient returns an FCM client that talks to a fake FCM server,
+// which records the sent messages and responds with status and body
+func newTestFCMClient(t *testing.T, status int, body string, sent *[]map[string]any) *messaging.Client {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var req struct {
+			Message map[string]any `json:"message"`
+		}
+		json.Unmarshal(b, &req)
+		*sent = append(*sent, req.Message)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: "test"},
+		option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// fcmError returns the body of an FCM error response with errorCode
+func fcmError(status, errorCode string) string {
+	return `{"error": {"status": "` + status + `", "message": "test error", "details": [{
+		"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+		"errorCode": "` + errorCode + `"}]}}`
+}
+
+// gcmNotification returns the message notification of testNotification for
+// an FCM token
+func gcmNotification() *RCPushNotification {
+	n := testNotification("fcm-token", "")
+	n.Options.From = "sender"
+	return n
+}
+
+func TestGCMHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		fcmStatus int
+		fcmBody   string
+		status    int
+		forwarded bool
+	}{
+		{"success", nil, http.StatusOK, `{"name": "projects/test/messages/1"}`, http.StatusOK, false},
+		{"unregistered", nil, http.StatusNotFound, fcmError("NOT_FOUND", "UNREGISTERED"), http.StatusNotAcceptable, false},
+		{"sender id mismatch", nil, http.StatusForbidden, fcmError("PERMISSION_DENIED", "SENDER_ID_MISMATCH"), http.StatusOK, true},
+		{"sender id mismatch without forwarding", map[string]string{"RCPG_FORWARD_ENABLED": "false"},
+			http.StatusForbidden, fcmError("PERMISSION_DENIED", "SENDER_ID_MISMATCH"), http.StatusForbidden, false},
+		{"sender id mismatch not forwarded", map[string]string{"RCPG_FCM_FORWARD_ON_MISMATCH": "false"},
+			http.StatusForbidden, fcmError("PERMISSION_DENIED", "SENDER_ID_MISMATCH"), http.StatusBadRequest, false},
+		{"invalid argument", nil, http.StatusBadRequest, fcmError("INVALID_ARGUMENT", "INVALID_ARGUMENT"), http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			var sent []map[string]any
+			cfg := testConfigEnv(fakeUpstream(http.StatusOK, &forwarded), tt.env)
+			client := newTestFCMClient(t, tt.fcmStatus, tt.fcmBody, &sent)
+			handler := withRCRequest(cfg, newGCMHandler(cfg, client), false)
+
+			w := httptest.NewRecorder()
+			handler(w, pushRequest("/push/gcm/send", notificationBody(gcmNotification())))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+			if (forwarded != nil) != tt.forwarded {
+				t.Fatalf("forwarded = %t, want %t", forwarded != nil, tt.forwarded)
+			}
+			if forwarded != nil && forwarded.URL.String() != "https://"+upstreamGateway+"/push/gcm/send" {
+				t.Errorf("forwarded to %s", forwarded.URL)
+			}
+		})
+	}
+}
+
+func TestGCMHandlerMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		edit func(n *RCPushNotification)
+		// contains and omits are checked against the marshaled message
+		contains []string
+		omits    []string
+	}{
+		{name: "message", contains: []string{`"token":"fcm-token"`, `"collapse_key":"sender"`, `"priority":"high"`,
+			`"title":"Alice"`, `"message":"Hello"`, `"msgcnt":"0"`}, omits: []string{`"notification"`, `"ttl"`}},
+		{name: "collapse by room", env: map[string]string{"RCPG_FCM_COLLAPSE_KEY": "room"}, contains: []string{`"collapse_key":"r1"`}},
+		{name: "message-id-only", edit: func(n *RCPushNotification) {
+			n.Options.Payload.NotificationType = "message-id-only"
+		}, contains: []string{`"priority":"normal"`}},
+		{name: "channel", env: map[string]string{"RCPG_FCM_CHANNEL_ID": "chat"},
+			contains: []string{`"notification":{"body":"Hello","channel_id":"chat","title":"Alice"}`}},
+		{name: "image", edit: func(n *RCPushNotification) {
+			json.Unmarshal([]byte(`{"image": "https://example.com/a.png"}`), &n.Options.Gcm)
+		}, contains: []string{`"image":"https://example.com/a.png"`}, omits: []string{`"notification"`}},
+		{name: "native image", env: map[string]string{"RCPG_FCM_NATIVE_IMAGE": "true"}, edit: func(n *RCPushNotification) {
+			json.Unmarshal([]byte(`{"image": "https://example.com/a.png"}`), &n.Options.Gcm)
+		}, contains: []string{`"notification":{"body":"Hello","image":"https://example.com/a.png","title":"Alice"}`}},
+		{name: "ttl", env: map[string]string{"RCPG_FCM_TTL": "60"}, contains: []string{`"ttl":"60s"`}},
+		{name: "analytics label", env: map[string]string{"RCPG_FCM_ANALYTICS_LABEL": "chat"},
+			contains: []string{`"fcm_options":{"analytics_label":"chat"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []map[string]any
+			cfg := testConfigEnv(nil, tt.env)
+			client := newTestFCMClient(t, http.StatusOK, `{"name": "projects/test/messages/1"}`, &sent)
+			handler := withRCRequest(cfg, newGCMHandler(cfg, client), false)
+			n := gcmNotification()
+			if tt.edit != nil {
+				tt.edit(n)
+			}
+			handler(httptest.NewRecorder(), pushRequest("/push/gcm/send", notificationBody(n)))
+			if len(sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(sent))
+			}
+
+			b, _ := json.Marshal(sent[0])
+			for _, want := range tt.contains {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("message without %s: %s", want, b)
+				}
+			}
+			for _, unwanted := range tt.omits {
+				if strings.Contains(string(b), unwanted) {
+					t.Errorf("message with %s: %s", unwanted, b)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTitleAndMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		title, text string
+		payload     *RCPayload
+		wantTitle   string
+		wantMessage string
+	}{
+		{"both set", "Alice", "Hello", &RCPayload{SenderName: "Bob"}, "Alice", "Hello"},
+		{"no title", "", "Hello", &RCPayload{SenderName: "Bob"}, "Bob", "Hello"},
+		{"no title or sender", "", "Hello", &RCPayload{Host: "https://chat.example.com"}, "chat.example.com", "Hello"},
+		{"no title or payload", "", "Hello", nil, "", "Hello"},
+		{"no text", "Alice", "", nil, "Alice", defaultFilterMessage},
+		{"neither", "", "", &RCPayload{SenderName: "Bob"}, "Bob", defaultFilterMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &rcRequest{}
+			r.data.Options.Title = tt.title
+			r.data.Options.Text = tt.text
+			r.data.Options.Payload = tt.payload
+			title, message := r.getTitleAndMessage(testConfig(nil))
+			if title != tt.wantTitle || message != tt.wantMessage {
+				t.Errorf("got %q, %q, want %q, %q", title, message, tt.wantTitle, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestCheckFCM(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		pass   bool
+	}{
+		{http.StatusBadRequest, fcmError("INVALID_ARGUMENT", "INVALID_ARGUMENT"), true},
+		{http.StatusNotFound, fcmError("NOT_FOUND", "UNREGISTERED"), true},
+		{http.StatusForbidden, fcmError("PERMISSION_DENIED", "SENDER_ID_MISMATCH"), false},
+		{http.StatusOK, `{"name": "projects/test/messages/1"}`, false},
+	}
+	for _, tt := range tests {
+		var sent []map[string]any
+		err := checkFCM(newTestFCMClient(t, tt.status, tt.body, &sent))
+		if (err == nil) != tt.pass {
+			t.Errorf("checkFCM with %d %s = %v, want pass %t", tt.status, tt.body, err, tt.pass)
+		}
+	}
+}
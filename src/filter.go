@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const defaultFilterMessage = "You have a new message"
+
+// loadFilterMessages loads the JSON object mapping locales to filter
+// messages from file, e.g. {"de": "Neue Nachricht"}
+func loadFilterMessages(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading RCPG_FILTER_MESSAGES_FILE: %w", err)
+	}
+	var messages map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("parsing RCPG_FILTER_MESSAGES_FILE: %w", err)
+	}
+	filterMessages := make(map[string]string, len(messages))
+	for locale, msg := range messages {
+		filterMessages[strings.ToLower(locale)] = msg
+	}
+	return filterMessages, nil
+}
+
+// message returns the filter message for locale, falling back to its
+// language and then to the default message
+func (c *FilterConfig) message(locale string) string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if msg, ok := c.Messages[locale]; ok {
+		return msg
+	}
+	lang, _, _ := strings.Cut(locale, "-")
+	if msg, ok := c.Messages[lang]; ok {
+		return msg
+	}
+	return c.Message
+}
+
+// senderName returns the display name of the sender of the notification
+func senderName(pl *RCPayload) string {
+	if pl.SenderName != "" {
+		return pl.SenderName
+	}
+	if pl.Sender != nil {
+		if pl.Sender.Name != "" {
+			return pl.Sender.Name
+		}
+		return pl.Sender.Username
+	}
+	return ""
+}
+
+// filter replaces the content of the notification with a generic message and
+// converts it to message-id-only, so the app has to fetch the content itself.
+// With RCPG_FILTER_KEEP_SENDER the sender name is kept as title and is the
+// only field carried over into the payload besides the message id.
+func (r *rcRequest) filter(c *FilterConfig) {
+	pl := r.data.Options.Payload
+	r.toMessageIDOnly(c)
+	if c.KeepSender {
+		name := senderName(pl)
+		r.data.Options.Title = name
+		r.data.Options.Payload.SenderName = name
+	}
+}
+
+// toMessageIDOnly converts the notification to message-id-only: only the
+// message id and the host are kept, and the alert is the generic filter
+// message, so the content never leaves the server with the push
+func (r *rcRequest) toMessageIDOnly(c *FilterConfig) {
+	pl := r.data.Options.Payload
+	r.data.Options.Title = ""
+	r.data.Options.Text = c.message(r.data.Options.Locale)
+	r.data.Options.Payload = &RCPayload{
+		Host:             pl.Host,
+		MessageID:        pl.MessageID,
+		NotificationType: "message-id-only",
+	}
+	r.body = nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// pendingWork counts queued and in-flight work of a background worker, so it
+// can be waited for on shutdown
+type pendingWork struct {
+	wg sync.WaitGroup
+	n  atomic.Int64
+}
+
+func (p *pendingWork) add() {
+	p.wg.Add(1)
+	p.n.Add(1)
+}
+
+func (p *pendingWork) done() {
+	p.n.Add(-1)
+	p.wg.Done()
+}
+
+// wait waits until all pending work is done or ctx ends. It returns the amount
+// of work that was pending and how much of it was left unfinished.
+func (p *pendingWork) wait(ctx context.Context) (pending, left int) {
+	pending = int(p.n.Load())
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return pending, 0
+	case <-ctx.Done():
+		return pending, int(p.n.Load())
+	}
+}
+
+// flush finishes the async deliveries, then posts their results to the
+// webhook, writes the dead letters, saves the stats, reports the suppressed
+// errors and exports the traces, so nothing is lost on shutdown
+func flush(ctx context.Context, cfg *Config) {
+	var deliveries, left int
+	if cfg.async != nil {
+		n, l := cfg.async.pending.wait(ctx)
+		deliveries += n
+		left += l
+	}
+	if cfg.webhook != nil {
+		n, l := cfg.webhook.pending.wait(ctx)
+		deliveries += n
+		left += l
+	}
+	if cfg.deadLetters != nil {
+		if _, l := cfg.deadLetters.pending.wait(ctx); l > 0 {
+			log.Printf("Dropped %d dead letters after the shutdown timeout", l)
+		}
+	}
+	saved := 0
+	if cfg.StatsFile != "" {
+		var err error
+		saved, err = saveStats(cfg.StatsFile)
+		if err != nil {
+			log.Printf("Failed to save stats: %v", err)
+		}
+	}
+	log.Printf("Flushed %d stats / %d pending deliveries", saved, deliveries-left)
+	if left > 0 {
+		log.Printf("Dropped %d pending deliveries after the shutdown timeout", left)
+	}
+	errorLog.stop()
+	shutdownTracing(ctx)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// filterRule selects the clients with forced filtering by their id, ip and
+// host, empty fields match every client
+type filterRule struct {
+	ID   string `json:"id,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+func (f filterRule) matches(s *status) bool {
+	return (f.ID == "" || f.ID == s.id) && (f.IP == "" || f.IP == s.ip) && (f.Host == "" || f.Host == s.host)
+}
+
+// forceFilterSet holds the rules set on /stats/filter. They're kept apart
+// from the stats, so they survive resets and evictions, and can be set before
+// a server sent its first notification.
+type forceFilterSet struct {
+	mu    sync.RWMutex
+	rules map[filterRule]bool
+}
+
+var forceFilters = &forceFilterSet{rules: map[filterRule]bool{}}
+
+// set adds or removes rule
+func (f *forceFilterSet) set(rule filterRule, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if enabled {
+		f.rules[rule] = true
+	} else {
+		delete(f.rules, rule)
+	}
+}
+
+// matches reports whether filtering is forced for the client
+func (f *forceFilterSet) matches(s *status) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for rule := range f.rules {
+		if rule.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the rules in a stable order
+func (f *forceFilterSet) list() []filterRule {
+	f.mu.RLock()
+	rules := make([]filterRule, 0, len(f.rules))
+	for rule := range f.rules {
+		rules = append(rules, rule)
+	}
+	f.mu.RUnlock()
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		return a.Host < b.Host
+	})
+	return rules
+}
+
+// forceFilterFile is where the rules are persisted next to RCPG_STATS_FILE
+func forceFilterFile(statsFile string) string {
+	return statsFile + ".filter"
+}
+
+// loadForceFilters restores the rules from file, like loadStats
+func loadForceFilters(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read force filter file: %v", err)
+		}
+		return
+	}
+	var rules []filterRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		log.Printf("Ignoring corrupt force filter file: %v", err)
+		return
+	}
+	for _, rule := range rules {
+		forceFilters.set(rule, true)
+	}
+	log.Printf("Loaded %d force filter rules from %s", len(rules), file)
+}
+
+// saveForceFilters writes the rules to file, replacing it atomically
+func saveForceFilters(file string) error {
+	data, err := json.Marshal(forceFilters.list())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// hostLimiterSweepInterval is how often idle host limiters are removed
+const hostLimiterSweepInterval = time.Minute
+
+// hostLimiters maps hosts to their *rate.Limiter
+var hostLimiters sync.Map
+
+// allowHost reports whether a request of host is within
+// RCPG_HOST_RATE_LIMIT. Requests without host are only limited per client.
+func (c *Config) allowHost(host string) bool {
+	if c.HostRateLimit <= 0 || host == "" {
+		return true
+	}
+	l, ok := hostLimiters.Load(host)
+	if !ok {
+		l, _ = hostLimiters.LoadOrStore(host, newLimiter(c.HostRateLimit, c.HostRateBurst))
+	}
+	return l.(*rate.Limiter).Allow()
+}
+
+// newLimiter returns a limiter of limit requests per second, a burst below 1
+// defaults to one more than limit
+func newLimiter(limit float64, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = int(limit) + 1
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// runHostLimiterSweep periodically removes the idle host limiters
+func runHostLimiterSweep() {
+	for range time.Tick(hostLimiterSweepInterval) {
+		sweepHostLimiters()
+	}
+}
+
+// sweepHostLimiters removes the limiters that are full again, they behave
+// like new ones, so the map doesn't grow with every host ever seen
+func sweepHostLimiters() {
+	hostLimiters.Range(func(k, v any) bool {
+		l := v.(*rate.Limiter)
+		if l.Tokens() >= float64(l.Burst()) {
+			hostLimiters.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultInvalidTokensHistory = 100
+
+// invalidTokenLog keeps the most recent tokens that were reported to
+// Rocket.Chat as invalid, redacted, to quantify the token churn
+type invalidTokenLog struct {
+	mu      sync.Mutex
+	entries []invalidToken
+	next    int
+	total   atomic.Uint64
+}
+
+type invalidToken struct {
+	Time     time.Time `json:"time"`
+	Token    string    `json:"token"`
+	Backend  string    `json:"backend"`
+	Reason   string    `json:"reason"`
+	UniqueID string    `json:"uniqueId,omitempty"`
+	Host     string    `json:"host,omitempty"`
+}
+
+// invalidTokens is replaced by main with the RCPG_INVALID_TOKENS_HISTORY
+var invalidTokens = newInvalidTokenLog(defaultInvalidTokensHistory)
+
+// newInvalidTokenLog creates the log keeping the n most recent tokens
+func newInvalidTokenLog(n int) *invalidTokenLog {
+	return &invalidTokenLog{entries: make([]invalidToken, 0, n)}
+}
+
+// add records the invalid token, replacing the oldest entry if the history is
+// full
+func (l *invalidTokenLog) add(e invalidToken) {
+	l.total.Add(1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case cap(l.entries) == 0:
+	case len(l.entries) < cap(l.entries):
+		l.entries = append(l.entries, e)
+	default:
+		l.entries[l.next] = e
+		l.next = (l.next + 1) % len(l.entries)
+	}
+}
+
+// reset clears the history and the total
+func (l *invalidTokenLog) reset() {
+	l.total.Store(0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// recent returns the recorded tokens, newest first
+func (l *invalidTokenLog) recent() []invalidToken {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := make([]invalidToken, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		recent = append(recent, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return recent
+}
+
+// invalidToken counts token as invalid for the client and records it
+func (r *rcRequest) invalidToken(token, backend, reason string) {
+	r.stats.invalidTokens.Add(1)
+	invalidTokens.add(invalidToken{
+		Time:     time.Now(),
+		Token:    redactToken(token),
+		Backend:  backend,
+		Reason:   reason,
+		UniqueID: r.data.Options.UniqueID,
+		Host:     r.host,
+	})
+}
+
+// invalidTokensHandler lists the most recent invalid tokens with the total
+// number since the start
+func invalidTokensHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("InvalidTokensHandler for %s from %s", r.RequestURI, getIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"total":  invalidTokens.total.Load(),
+		"recent": invalidTokens.recent(),
+	})
+}
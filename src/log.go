@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+var (
+	// logConfig is set by setupLog, until then info is logged as text
+	logConfig = LogConfig{Level: levelInfo}
+	jsonLogMu sync.Mutex
+)
+
+// logLevelByName returns the level of name, which must be one of levelNames
+func logLevelByName(name string) int {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return i
+		}
+	}
+	return levelInfo
+}
+
+// setupLog configures the logging of the process
+func setupLog(c LogConfig) {
+	logConfig = c
+	if c.JSON {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	}
+}
+
+type logEntry struct {
+	Time      string  `json:"time"`
+	ReqID     uint    `json:"req_id,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Level     string  `json:"level"`
+	Msg       string  `json:"msg"`
+	Host      string  `json:"host,omitempty"`
+	UniqueID  string  `json:"uniqueId,omitempty"`
+	IP        string  `json:"ip,omitempty"`
+	Method    string  `json:"method,omitempty"`
+	Path      string  `json:"path,omitempty"`
+	Body      string  `json:"body,omitempty"`
+	Backend   string  `json:"backend,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+}
+
+func writeJSONLog(e *logEntry) {
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	b, _ := json.Marshal(e)
+	b = append(b, '\n')
+	jsonLogMu.Lock()
+	defer jsonLogMu.Unlock()
+	os.Stderr.Write(b)
+}
+
+// jsonLogWriter wraps the output of the standard logger into JSON lines
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog(&logEntry{
+		Level: "info",
+		Msg:   strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
+
+// redactToken masks all but the last 4 characters of a device token
+func redactToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
+
+// redact masks the device token and omits the message content in s, if
+// RCPG_REDACT_LOGS is enabled. All request logging goes through here, so no
+// call site can leak them by accident.
+func (r *rcRequest) redact(s string) string {
+	if !logConfig.Redact {
+		return s
+	}
+	var pairs []string
+	add := func(secret, replacement string) {
+		if secret == "" {
+			return
+		}
+		pairs = append(pairs, secret, replacement)
+		// also catch the secret when it's embedded in marshaled JSON
+		quoted, _ := json.Marshal(secret)
+		if escaped := string(quoted[1 : len(quoted)-1]); escaped != secret {
+			pairs = append(pairs, escaped, replacement)
+		}
+	}
+	add(string(r.body), "[body]")
+	if r.data.Options.Payload != nil {
+		add(string(r.ejson), "[payload]")
+	}
+	add(r.data.Token, redactToken(r.data.Token))
+	add(r.data.APNToken, redactToken(r.data.APNToken))
+	add(r.data.GCMToken, redactToken(r.data.GCMToken))
+	for _, token := range r.data.Options.Tokens {
+		add(token, redactToken(token))
+	}
+	add(r.data.Options.Title, "[title]")
+	add(r.data.Options.Text, "[text]")
+	if len(pairs) == 0 {
+		return s
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+func (r *rcRequest) logEntry(level int, msg string) *logEntry {
+	return &logEntry{
+		ReqID:     r.id,
+		RequestID: r.requestID,
+		Level:     levelNames[level],
+		Msg:       msg,
+		Host:      r.host,
+		UniqueID:  r.data.Options.UniqueID,
+		IP:        r.ip,
+	}
+}
+
+func (r *rcRequest) logf(level int, s string, v ...any) {
+	msg := r.redact(fmt.Sprintf(s, v...))
+	if logConfig.JSON {
+		writeJSONLog(r.logEntry(level, msg))
+		return
+	}
+	log.Printf("[%d] [%s] %s", r.id, r.requestID, msg)
+}
+
+func (r *rcRequest) Printf(s string, v ...any) {
+	if logConfig.Level < levelInfo {
+		return
+	}
+	r.logf(levelInfo, s, v...)
+}
+
+func (r *rcRequest) Debugf(s string, v ...any) {
+	if logConfig.Level < levelDebug {
+		return
+	}
+	r.logf(levelDebug, s, v...)
+}
+
+func (r *rcRequest) Errorf(s string, v ...any) {
+	if !errorLog.allow(s, r.backend, time.Now()) {
+		return
+	}
+	if logConfig.JSON {
+		e := r.logEntry(levelError, r.redact(fmt.Sprintf(s, v...)))
+		e.Method = r.http.Method
+		e.Path = r.http.URL.Path
+		e.Body = r.redact(string(r.body))
+		writeJSONLog(e)
+		return
+	}
+	// never dump the request, its headers contain the bearer token
+	s = s + "\nRequest: %s %s from %s"
+	v = append(v, r.http.Method, r.http.URL.Path, r.http.RemoteAddr)
+	s = s + "\nBody: %s"
+	v = append(v, r.body)
+	r.logf(levelError, s, v...)
+}
+
+// errorLogLimiter collapses errors that repeat within window, so a failing
+// backend doesn't flood the logs. Errors are identical if they have the same
+// format string and backend.
+type errorLogLimiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[uint64]*errorLogEntry
+	done    chan struct{}
+}
+
+type errorLogEntry struct {
+	start      time.Time
+	format     string
+	backend    string
+	suppressed int
+}
+
+// errorLog is set by main if RCPG_ERROR_LOG_WINDOW is set, nil logs every
+// error
+var errorLog *errorLogLimiter
+
+// newErrorLogLimiter creates the limiter and starts sweeping it every window,
+// until it's stopped
+func newErrorLogLimiter(window time.Duration) *errorLogLimiter {
+	l := &errorLogLimiter{
+		window:  window,
+		entries: make(map[uint64]*errorLogEntry),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				l.sweep(now)
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// stop stops the sweeping and reports the repetitions of the open windows
+func (l *errorLogLimiter) stop() {
+	if l == nil {
+		return
+	}
+	close(l.done)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.entries {
+		l.report(e)
+		delete(l.entries, key)
+	}
+}
+
+// allow reports whether the error should be logged, which is the first time
+// within the window. The repetitions are reported when the window ends.
+func (l *errorLogLimiter) allow(format, backend string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(format))
+	h.Write([]byte{0})
+	h.Write([]byte(backend))
+	key := h.Sum64()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		if now.Sub(e.start) < l.window {
+			e.suppressed++
+			return false
+		}
+		l.report(e)
+	}
+	l.entries[key] = &errorLogEntry{start: now, format: format, backend: backend}
+	return true
+}
+
+// sweep reports and removes the errors whose window ended
+func (l *errorLogLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.entries {
+		if now.Sub(e.start) >= l.window {
+			l.report(e)
+			delete(l.entries, key)
+		}
+	}
+}
+
+func (l *errorLogLimiter) report(e *errorLogEntry) {
+	if e.suppressed == 0 {
+		return
+	}
+	log.Printf("Error repeated %d times in the last %s (backend %q): %q",
+		e.suppressed, l.window, e.backend, e.format)
+}
+
+// logAccess writes the access log line of a completed request, if
+// RCPG_ACCESS_LOG is enabled
+func (r *rcRequest) logAccess(status int, latency time.Duration) {
+	if !logConfig.Access {
+		return
+	}
+	if logConfig.JSON {
+		e := r.logEntry(levelInfo, "access")
+		e.Method = r.http.Method
+		e.Path = r.http.URL.Path
+		e.Backend = r.backend
+		e.Status = status
+		e.LatencyMs = float64(latency.Microseconds()) / 1000
+		writeJSONLog(e)
+		return
+	}
+	log.Printf("[%d] [%s] access ip=%s host=%s id=%s path=%s backend=%s status=%d latency=%s",
+		r.id, r.requestID, r.ip, r.host, r.data.Options.UniqueID, r.http.URL.Path,
+		r.backend, status, latency)
+}
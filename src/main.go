@@ -2,29 +2,56 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	apnsUpstreamTopic = "chat.rocket.ios"
 	upstreamGateway   = "gateway.rocket.chat"
+	shutdownTimeout   = 10 * time.Second
+	defaultAddr       = ":8080"
+	// defaultReadTimeout is plenty for a push request, which is small
+	defaultReadTimeout = 30 * time.Second
 )
 
-var (
-	apnsTopic = os.Getenv("RCPG_APNS_TOPIC")
-	debug, _  = strconv.ParseBool(os.Getenv("RCPG_DEBUG"))
-	reqID     atomic.Uintptr
-)
+var reqID atomic.Uintptr
+
+// validateAddr checks that addr is a valid host:port listen address
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return nil
+}
 
 // RCPushNotification is a struct to hold the JSON payload
 type RCPushNotification struct {
@@ -39,20 +66,34 @@ type RCPushNotification struct {
 		Text      string     `json:"text"`
 		UserID    string     `json:"userId"`
 		Payload   *RCPayload `json:"payload,omitempty"`
-		Badge     int        `json:"badge,omitempty"`
+		Badge     *int       `json:"badge,omitempty"`
 		Sound     string     `json:"sound"`
 		NotID     int        `json:"notId,omitempty"`
 		Apn       *struct {
-			Category string `json:"category,omitempty"`
-			Text     string `json:"text,omitempty"`
+			Category string  `json:"category,omitempty"`
+			Text     string  `json:"text,omitempty"`
+			Critical bool    `json:"critical,omitempty"`
+			Volume   float32 `json:"volume,omitempty"`
+			// PushType ("alert" or "background") and ContentAvailable
+			// override the defaults derived from the notification type
+			PushType         string `json:"pushType,omitempty"`
+			ContentAvailable bool   `json:"contentAvailable,omitempty"`
 		} `json:"apn,omitempty"`
 		Gcm *struct {
 			Image string `json:"image,omitempty"`
 			Style string `json:"style,omitempty"`
 		} `json:"gcm,omitempty"`
-		Topic    string `json:"topic,omitempty"`
-		UniqueID string `json:"uniqueId"`
+		Topic    string   `json:"topic,omitempty"`
+		UniqueID string   `json:"uniqueId"`
+		Tokens   []string `json:"tokens,omitempty"`
+		Locale   string   `json:"locale,omitempty"`
 	} `json:"options"`
+	// Platform, APNToken and GCMToken are only used by /push/send
+	Platform string `json:"platform,omitempty"`
+	APNToken string `json:"apnToken,omitempty"`
+	GCMToken string `json:"gcmToken,omitempty"`
+	// aliases are the field aliases the request used, see fieldAliases
+	aliases []string
 }
 
 type RCPayload struct {
@@ -67,47 +108,106 @@ type RCPayload struct {
 	} `json:"sender,omitempty"`
 	SenderName string `json:"senderName,omitempty"`
 	Type       string `json:"type,omitempty"`
+	// Name is the room name, it's only set for rooms that have one
+	Name string `json:"name,omitempty"`
 }
 
 type rcRequest struct {
-	id    uint
-	http  *http.Request
-	body  []byte
-	data  RCPushNotification
-	ejson []byte
-	stats *status
+	id        uint
+	requestID string
+	ip        string
+	host      string
+	http      *http.Request
+	body      []byte
+	data      RCPushNotification
+	ejson     []byte
+	stats     *status
+	// backend is the backend that handled the request, for the access log
+	backend string
+	// apnsExpiration and apnsPriority are set by the apns-expiration and
+	// apns-priority request headers, to override the defaults
+	apnsExpiration *time.Time
+	apnsPriority   int
+	// retry is set when async delivery runs the handler again, so the
+	// notification is only counted once
+	retry bool
+	// tokenDeleted is set when the response tells Rocket.Chat to delete the
+	// device token
+	tokenDeleted bool
 }
 
-func (r *rcRequest) Printf(s string, v ...any) {
-	id := fmt.Sprintf("[%d]", r.id)
-	s = id + " " + s
-	log.Printf(s, v...)
+const maxRequestIDLength = 128
+
+// getRequestID returns the X-Request-ID of the caller for correlating logs,
+// or generates a new one if it's missing or invalid
+func getRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	valid := id != "" && len(id) <= maxRequestIDLength
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (r *rcRequest) Debugf(s string, v ...any) {
-	if !debug {
-		return
+// getBadge returns the badge of the notification and whether it should be
+// set at all, see RCPG_DEFAULT_BADGE and RCPG_BADGE_OMIT_VALUE
+func (r *rcRequest) getBadge(cfg *Config) (int, bool) {
+	badge := r.data.Options.Badge
+	if badge == nil {
+		badge = cfg.DefaultBadge
 	}
-	r.Printf(s, v...)
+	return cfg.badge(badge)
 }
 
-func (r *rcRequest) Errorf(s string, v ...any) {
-	s = s + "\nRequest: %+v"
-	v = append(v, r.http)
-	s = s + "\nBody: %s"
-	v = append(v, r.body)
-	r.Printf(s, v...)
+// badge returns badge and whether it should be set, which it isn't if it's
+// nil or RCPG_BADGE_OMIT_VALUE
+func (c *Config) badge(badge *int) (int, bool) {
+	if badge == nil || c.BadgeOmitValue != nil && *badge == *c.BadgeOmitValue {
+		return 0, false
+	}
+	return *badge, true
 }
 
-func getIP(r *http.Request) string {
-	var ip string
-	fwdHdr := r.Header["X-Forwarded-For"]
-	if len(fwdHdr) == 0 {
-		ip = strings.Split(r.RemoteAddr, ":")[0]
-	} else {
-		ip = fwdHdr[0]
+// sendContext returns the context for sending the notification to a backend,
+// which ends with the request or after RCPG_SEND_TIMEOUT
+func (r *rcRequest) sendContext(cfg *Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.http.Context(), cfg.SendTimeout)
+}
+
+// isMessageIDOnly reports whether the notification is a silent
+// message-id-only notification, which the app fetches the content for
+func (r *rcRequest) isMessageIDOnly() bool {
+	pl := r.data.Options.Payload
+	return pl != nil && pl.NotificationType == "message-id-only"
+}
+
+// getSound returns the notification sound, which is RCPG_DEFAULT_SOUND if
+// none was requested, and none for silent notifications
+func (r *rcRequest) getSound(cfg *Config) string {
+	if r.isMessageIDOnly() {
+		return ""
 	}
-	return ip
+	if r.data.Options.Sound == "" {
+		return cfg.DefaultSound
+	}
+	return r.data.Options.Sound
+}
+
+// isAuthorized checks the bearer token if RCPG_AUTH_TOKEN is set
+func (c *Config) isAuthorized(r *http.Request) bool {
+	if c.AuthToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(c.AuthToken)) == 1
 }
 
 var infoText = `
@@ -121,89 +221,397 @@ https://github.com/ansiwen/rocketchat-push-gateway</a></p>
 </body></html>
 `
 
+// loadInfoPage returns the page served on /, which is infoText by default,
+// the content of file, or nothing if it's "off"
+func loadInfoPage(file string) (string, error) {
+	switch file {
+	case "":
+		return infoText, nil
+	case "off":
+		return "", nil
+	}
+	page, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading RCPG_INFO_PAGE: %w", err)
+	}
+	return string(page), nil
+}
+
 func main() {
-	infoHandler := func(w http.ResponseWriter, req *http.Request) {
-		log.Printf("InfoHandler for %s from %s", req.RequestURI, getIP(req))
-		io.WriteString(w, infoText)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	setupLog(cfg.Log)
+	setupOutboundProxy(cfg.OutboundProxy)
+	if err := setupTracing(cfg.OTelEndpoint); err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies = cfg.TrustedProxies
+	invalidTokens = newInvalidTokenLog(cfg.Stats.InvalidTokensHistory)
+	if cfg.ErrorLogWindow > 0 {
+		errorLog = newErrorLogLimiter(cfg.ErrorLogWindow)
+	}
+	if cfg.DeadLetterFile != "" {
+		cfg.deadLetters, err = openDeadLetterFile(cfg.DeadLetterFile)
+		if err != nil {
+			log.Fatal("Failed to open RCPG_DEADLETTER_FILE: ", err)
+		}
+	}
+	if cfg.ResultWebhook != "" {
+		cfg.webhook = newResultWebhook(cfg.ResultWebhook)
+	}
+	if cfg.Async.Enabled {
+		cfg.async = newAsyncDelivery(cfg.Async, cfg.webhook, cfg.deadLetters)
+	}
+	if cfg.Dedup.Window > 0 {
+		cfg.dedup = newDedupCache(cfg.Dedup)
+	}
+	if cfg.MaxConcurrency > 0 {
+		cfg.pool = newSendPool(cfg.MaxConcurrency, cfg.MaxQueue)
+	}
+
+	infoPage, err := loadInfoPage(cfg.InfoPage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Stats.User == "" && cfg.Stats.Pass == "" {
+		log.Println("The stats page is public, set RCPG_STATS_USER and RCPG_STATS_PASS to protect it")
 	}
-	http.HandleFunc("/", infoHandler)
 
-	http.HandleFunc("/stats", statsHandler)
+	apnHandler, gcmHandler := disabledHandler("APNs"), disabledHandler("FCM")
+	if cfg.APNS.Enabled {
+		apnHandler = getAPNPushNotificationHandler(cfg)
+	} else {
+		log.Println("APNs is disabled by RCPG_APNS_ENABLED")
+	}
+	if cfg.FCM.Enabled {
+		gcmHandler = getGCMPushNotificationHandler(cfg)
+	} else {
+		log.Println("FCM is disabled by RCPG_FCM_ENABLED")
+	}
+	mux := newServeMux(cfg, infoPage, apnHandler, gcmHandler)
+	if cfg.PProf {
+		log.Println("Serving pprof profiles on /debug/pprof/")
+		registerPprof(cfg, mux)
+	}
+
+	if cfg.HostRateLimit > 0 {
+		go runHostLimiterSweep()
+	}
+
+	statsFile := cfg.StatsFile
+	if statsFile != "" {
+		loadStats(statsFile)
+		loadForceFilters(forceFilterFile(statsFile))
+		go flushStats(statsFile)
+	}
 
-	// Define the HTTP server and routes
-	http.HandleFunc("/push/gcm/send", withRCRequest(getGCMPushNotificationHandler(), false))
-	http.HandleFunc("/push/apn/send", withRCRequest(getAPNPushNotificationHandler(), false))
-	http.HandleFunc("/filter/push/gcm/send", withRCRequest(getGCMPushNotificationHandler(), true))
-	http.HandleFunc("/filter/push/apn/send", withRCRequest(getAPNPushNotificationHandler(), true))
 	// Start the HTTP server
-	addr := os.Getenv("RCPG_ADDR")
-	log.Println("Starting server on", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	addr := cfg.Addr
+	srv := &http.Server{Addr: addr, Handler: mux, ReadTimeout: cfg.ReadTimeout}
+	// idle is closed when Shutdown returned, ListenAndServe returns before
+	// the requests in flight are done
+	idle := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down server")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to finish the requests in flight: %v", err)
+		}
+		close(idle)
+	}()
+	if cfg.TLSCertFile != "" {
+		var reloader *certReloader
+		reloader, err = newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatal("Failed to load TLS certificate: ", err)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		log.Println("Starting TLS server on", addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Println("Starting server on", addr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("Failed to start server: ", err)
 	}
+	<-idle
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	flush(ctx, cfg)
 }
 
-func withRCRequest(handler func(http.ResponseWriter, *rcRequest), filter bool) func(http.ResponseWriter, *http.Request) {
+// newServeMux returns the mux with all routes of the gateway. It's a separate
+// mux, so nothing gets exposed by registering itself on the default one, like
+// net/http/pprof does.
+func newServeMux(cfg *Config, infoPage string, apnHandler, gcmHandler func(http.ResponseWriter, *rcRequest)) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	infoHandler := func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("InfoHandler for %s from %s", req.RequestURI, getIP(req))
+		if infoPage == "" {
+			http.NotFound(w, req)
+			return
+		}
+		io.WriteString(w, infoPage)
+	}
+	mux.HandleFunc("/", infoHandler)
+
+	mux.HandleFunc("/stats", withStatsAuth(cfg, statsHandler))
+	mux.HandleFunc("/stats/reset", withAdmin(cfg, statsResetHandler))
+	mux.HandleFunc("/stats/filter", withAdmin(cfg, forceFilterHandler))
+	mux.HandleFunc("/stats/enable-forwarding", withAdmin(cfg, enableForwardingHandler))
+	mux.HandleFunc("/stats/invalid-tokens", withStatsAuth(cfg, invalidTokensHandler))
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/config", withAuthToken(cfg, configHandler(cfg)))
+
+	// Push routes
+	mux.HandleFunc("/push/gcm/send", withRCRequest(cfg, gcmHandler, false))
+	mux.HandleFunc("/push/apn/send", withRCRequest(cfg, apnHandler, false))
+	mux.HandleFunc("/filter/push/gcm/send", withRCRequest(cfg, gcmHandler, true))
+	mux.HandleFunc("/filter/push/apn/send", withRCRequest(cfg, apnHandler, true))
+	mux.HandleFunc("/push/send", withRCRequest(cfg, getFanOutHandler(map[string]func(http.ResponseWriter, *rcRequest){
+		"apn": apnHandler,
+		"gcm": gcmHandler,
+	}), false))
+	mux.HandleFunc("/test/gcm", withAdmin(cfg, testSendHandler(cfg, gcmHandler)))
+	mux.HandleFunc("/test/apn", withAdmin(cfg, testSendHandler(cfg, apnHandler)))
+	return mux
+}
+
+func withRCRequest(cfg *Config, handler func(http.ResponseWriter, *rcRequest), filter bool) func(http.ResponseWriter, *http.Request) {
+	if cfg.async != nil {
+		handler = cfg.async.wrap(handler)
+	}
 	return func(w http.ResponseWriter, http_ *http.Request) {
+		start := time.Now()
+		ctx, span := startRequestSpan(http_)
+		http_ = http_.WithContext(ctx)
 		r := &rcRequest{http: http_}
 		r.id = uint(reqID.Add(1))
+		r.requestID = getRequestID(http_)
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			r.logAccess(sw.statusCode(), time.Since(start))
+			endRequestSpan(span, r, sw.statusCode())
+			// async deliveries report their result when they're done
+			if r.stats != nil && r.backend != "async" {
+				cfg.webhook.notify(r, sw.statusCode())
+				cfg.deadLetters.record(r, sw.statusCode(), sw.body)
+			}
+		}()
+		http_.Header.Set("X-Request-ID", r.requestID)
+		w.Header().Set("X-Request-ID", r.requestID)
 		if r.http.Method != http.MethodPost {
 			r.Errorf("Method not allowed: %v", r.http.Method)
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "this endpoint only accepts POST requests")
+			return
+		}
+
+		if !cfg.isAuthorized(r.http) {
+			r.Printf("Unauthorized request from %s", getIP(r.http))
+			writeError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid bearer token")
+			return
+		}
+
+		ct, _, _ := mime.ParseMediaType(http_.Header.Get("Content-Type"))
+		if ct != "application/json" {
+			r.Errorf("Unsupported content type: %s", http_.Header.Get("Content-Type"))
+			writeError(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType", "content type must be application/json")
 			return
 		}
 
 		// Read the request body
+		body := http_.Body
+		gzipped := strings.EqualFold(http_.Header.Get("Content-Encoding"), "gzip")
+		if gzipped {
+			zr, err := gzip.NewReader(http_.Body)
+			if err != nil {
+				r.Errorf("Failed to decompress request body: %v", err)
+				writeError(w, http.StatusBadRequest, "BadRequest", "failed to decompress request body")
+				return
+			}
+			defer zr.Close()
+			body = zr
+		}
 		var err error
-		r.body, err = io.ReadAll(http_.Body)
+		// limits the decompressed size for gzip encoded bodies
+		r.body, err = io.ReadAll(http.MaxBytesReader(w, body, cfg.MaxBodyBytes))
 		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				r.Errorf("Request body too large: %v", err)
+				writeError(w, http.StatusRequestEntityTooLarge, "RequestEntityTooLarge", err.Error())
+				return
+			}
 			r.Errorf("Failed to read request body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "BadRequest", "failed to read request body")
 			return
 		}
+		if gzipped {
+			// the body is forwarded decompressed
+			http_.Header.Del("Content-Encoding")
+			http_.Header.Del("Content-Length")
+			http_.ContentLength = int64(len(r.body))
+		}
 
-		r.Debugf("Received push request: %+v %s", http_, r.body)
+		r.Debugf("Received push request: %s %s from %s %s", http_.Method, http_.URL.Path, http_.RemoteAddr, r.body)
 
 		// Parse the request body
-		err = json.Unmarshal(r.body, &r.data)
+		err = r.data.decode(r.body, cfg.StrictJSON)
 		if err != nil {
 			r.Errorf("Failed to parse request body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "BadRequest", "failed to parse request body: "+err.Error())
 			return
 		}
+		if len(r.data.aliases) > 0 {
+			r.Debugf("Request uses the field aliases %v", r.data.aliases)
+		}
+		r.parseAPNSHeaders()
 
-		var host string
+		if r.data.Token == "" && len(r.data.Options.Tokens) == 0 &&
+			r.data.APNToken == "" && r.data.GCMToken == "" {
+			r.Errorf("Missing token")
+			writeError(w, http.StatusBadRequest, "MissingField", "missing field: token")
+			return
+		}
 
 		if r.data.Options.Payload != nil {
-			host = r.data.Options.Payload.Host
-			if filter && r.data.Options.Payload.NotificationType == "message" {
-				r.data.Options.Title = ""
-				r.data.Options.Text = "You have a new message"
-				pl := r.data.Options.Payload
-				r.data.Options.Payload = &RCPayload{
-					Host:             pl.Host,
-					MessageID:        pl.MessageID,
-					NotificationType: "message-id-only",
-				}
-				r.body = nil
-			}
-			r.ejson, _ = json.Marshal(r.data.Options.Payload)
+			r.host = r.data.Options.Payload.Host
 		}
 
-		ip := getIP(r.http)
+		r.ip = getIP(r.http)
 
-		r.stats = getStats(r.data.Options.UniqueID, ip, host)
+		r.stats = getStats(r.data.Options.UniqueID, r.ip, r.host)
+		limitStats(cfg.Stats.MaxEntries)
 
+		if r.data.Options.Payload != nil {
+			if r.data.Options.Payload.NotificationType == "message" {
+				if filter || forceFilters.matches(r.stats) {
+					r.filter(&cfg.Filter)
+				} else if cfg.ForceMessageIDOnly {
+					r.toMessageIDOnly(&cfg.Filter)
+				}
+			}
+			r.ejson, _ = json.Marshal(r.data.Options.Payload)
+		} else {
+			// e.g. test notifications have no payload, the apps expect
+			// valid JSON nevertheless
+			r.Debugf("Request has no payload, sending empty ejson")
+			r.ejson = []byte("{}")
+		}
 		r.Printf("%s requested from %s;Id:%s;Host:%s",
 			r.http.URL.RequestURI(),
-			ip,
+			r.ip,
 			r.data.Options.UniqueID,
-			host)
+			r.host)
+
+		if !cfg.allowClient(r.stats) {
+			r.Printf("Rate limit exceeded")
+			writeError(w, http.StatusTooManyRequests, "TooManyRequests", "rate limit exceeded")
+			return
+		}
+
+		if !cfg.allowHost(r.host) {
+			r.Printf("Rate limit of host %s exceeded", r.host)
+			writeError(w, http.StatusTooManyRequests, "TooManyRequests", "rate limit of the host exceeded")
+			return
+		}
+		// rate limited requests aren't sent, so they don't count
+		r.stats.countType(r.data.Options.Payload)
+
+		if pl := r.data.Options.Payload; cfg.dedup != nil && pl != nil && pl.MessageID != "" {
+			key := r.data.Token + r.data.APNToken + r.data.GCMToken + "/" + pl.MessageID
+			if cfg.dedup.seen(key) {
+				r.stats.duplicates.Add(1)
+				r.Printf("Skipping duplicate notification for message %s", pl.MessageID)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			handler(w, r)
+			if sw.status >= 300 {
+				cfg.dedup.forget(key)
+			}
+			return
+		}
 
 		handler(w, r)
 	}
 }
 
+// statusWriter records the status code written to the ResponseWriter, and
+// the start of error responses for the dead-letter file
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// statusCode returns the status code of the response, where no response
+// means 200
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 300 && len(w.body) < maxDeadLetterError {
+		w.body = append(w.body, b...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// writeError responds with status and a JSON body describing the error
+func writeError(w http.ResponseWriter, status int, reason, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Reason: reason})
+}
+
+type successResponse struct {
+	Backend   string `json:"backend"`
+	Sent      bool   `json:"sent"`
+	ApnsID    string `json:"apnsId,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+}
+
+// writeSuccess responds with 200 and, if RCPG_SUCCESS_BODY is enabled, a
+// JSON body describing which backend handled the push
+func (c *Config) writeSuccess(w http.ResponseWriter, resp successResponse) {
+	if !c.SuccessBody {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -212,12 +620,79 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func forward(w http.ResponseWriter, r *rcRequest) {
-	r.stats.forwarded.Add(1)
+// parseHostList parses a comma separated list of hosts into a set
+func parseHostList(s string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(s, ",") {
+		if host = hostName(host); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// hostName returns the lower case host name of a host or URL
+func hostName(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+// isForwardAllowed checks the Rocket.Chat host against the forwarding allow
+// and deny lists, an empty allow list allows all hosts
+func (c *ForwardConfig) isForwardAllowed(host string) bool {
+	host = hostName(host)
+	if c.DeniedHosts[host] {
+		return false
+	}
+	return len(c.AllowedHosts) == 0 || c.AllowedHosts[host]
+}
+
+// platformRoutes are the paths of the single platform routes, which are
+// also the routes of the upstream gateway
+var platformRoutes = map[string]string{
+	"apn": "/push/apn/send",
+	"gcm": "/push/gcm/send",
+}
+
+// disabledHandler rejects the notifications of a backend disabled by RCPG_*_ENABLED
+func disabledHandler(backend string) func(http.ResponseWriter, *rcRequest) {
+	return func(w http.ResponseWriter, r *rcRequest) {
+		r.Printf("Rejecting notification, %s is disabled", backend)
+		writeError(w, http.StatusNotImplemented, "BackendNotEnabled", backend+" is disabled on this gateway")
+	}
+}
+
+// forward sends the request to the upstream gateway on the route of platform
+func forward(w http.ResponseWriter, r *rcRequest, cfg *Config, platform string) {
+	path, ok := platformRoutes[platform]
+	if !ok {
+		r.Errorf("No upstream route for platform %q", platform)
+		writeError(w, http.StatusInternalServerError, "ForwardingFailed", "no upstream route for platform "+platform)
+		return
+	}
+
+	if !cfg.Forward.Enabled {
+		r.Printf("Forwarding is disabled by RCPG_FORWARD_ENABLED")
+		writeError(w, http.StatusForbidden, "ForwardingNotEnabled", "forwarding to the upstream gateway is disabled")
+		return
+	}
+
+	if !cfg.Forward.isForwardAllowed(r.host) {
+		r.Printf("Forwarding not allowed for host %s", r.host)
+		writeError(w, http.StatusForbidden, "ForwardingNotAllowed", "forwarding is not allowed for this host")
+		return
+	}
+
+	r.stats.forwardAttempted.Add(1)
+	r.backend = "forwarded"
 
 	if r.stats.isDisabled() {
+		r.stats.forwardSkipped.Add(1)
 		r.Printf("Forwarding disabled")
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeError(w, http.StatusUnprocessableEntity, "ForwardingDisabled", "forwarding is temporarily disabled for this client")
 		return
 	}
 
@@ -225,14 +700,13 @@ func forward(w http.ResponseWriter, r *rcRequest) {
 	r.http.Host = ""
 	r.http.URL.Scheme = "https"
 	r.http.URL.Host = upstreamGateway
-	path := r.http.URL.Path
-	r.http.URL.Path = path[strings.LastIndex(path, "/push/"):]
+	r.http.URL.Path = path
 	if r.body == nil {
 		var err error
 		r.body, err = json.Marshal(r.data)
 		if err != nil {
 			r.Errorf("Failed to create filtered body: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "BadRequest", "failed to create filtered body")
 			return
 		}
 		r.http.Header.Del("Content-Length")
@@ -244,26 +718,108 @@ func forward(w http.ResponseWriter, r *rcRequest) {
 	r.http.Body, _ = r.http.GetBody()
 	r.http.Header.Del("Connection")
 
-	resp, err := http.DefaultClient.Do(r.http)
+	ctx, cancel := context.WithTimeout(r.http.Context(), cfg.Forward.Timeout)
+	defer cancel()
+	send := func() (any, error) {
+		ctx, span := startBackendSpan(ctx, "forward", "forwarded")
+		injectTraceContext(ctx, r.http.Header)
+		start := time.Now()
+		resp, err := cfg.Forward.client.Do(r.http.WithContext(ctx))
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		endSpan(span, nil, semconv.HTTPStatusCode(resp.StatusCode))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		res := &forwardResult{resp.StatusCode, resp.Header, body, time.Since(start)}
+		upstream.record(res.status, res.latency)
+		return res, nil
+	}
+	var v any
+	var err error
+	if cfg.Forward.SingleFlight {
+		var shared bool
+		v, err, shared = forwardGroup.Do(forwardKey(r), send)
+		if shared {
+			r.Debugf("Sharing the upstream result of a concurrent forward")
+		}
+	} else {
+		v, err = send()
+	}
 	if err != nil {
+		r.stats.forwardFailed.Add(1)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			r.Errorf("Forwarding request timed out: %v", err)
+			writeError(w, http.StatusGatewayTimeout, "ForwardingTimeout", err.Error())
+			return
+		}
 		r.Errorf("Failed to forward request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "ForwardingFailed", err.Error())
 		return
 	}
 
-	body, _ := io.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	r.Debugf("Response from upstream: %+v %s", resp, body)
-	copyHeader(w.Header(), resp.Header)
-	if resp.StatusCode >= 300 {
-		r.Printf("Forwarding failed: %s %s", resp.Status, body)
-		if resp.StatusCode == 422 {
-			r.stats.disable()
+	res := v.(*forwardResult)
+	r.Debugf("Response from upstream after %s: %d %v %s", res.latency, res.status, res.header, res.body)
+	copyHeader(w.Header(), res.header)
+	apnsID, messageID := res.deliveryIDs()
+	ids := ""
+	if apnsID != "" {
+		ids += ", apns-id: " + apnsID
+	}
+	if messageID != "" {
+		ids += ", message id: " + messageID
+	}
+	if res.status >= 300 {
+		r.stats.forwardFailed.Add(1)
+		r.Printf("Forwarding failed: %d %s%s", res.status, res.body, ids)
+		if res.status == 422 {
+			r.stats.disable(cfg.Forward.DisabledDelay)
 		}
+		// the upstream gateway tells Rocket.Chat to delete the token
+		r.tokenDeleted = res.status == cfg.InvalidTokenStatus
 	} else {
-		r.Printf("Forwarded request to upstream")
+		r.stats.forwardSucceeded.Add(1)
+		r.Printf("Forwarded request to upstream%s", ids)
+		if cfg.SuccessBody {
+			w.Header().Del("Content-Length")
+			cfg.writeSuccess(w, successResponse{Backend: "forwarded", Sent: true, ApnsID: apnsID, MessageID: messageID})
+			return
+		}
+	}
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+}
+
+// forwardKey identifies a notification for the single flight of forwards, so
+// only identical notifications of a client share an upstream request
+func forwardKey(r *rcRequest) string {
+	sum := sha256.Sum256(r.body)
+	return r.stats.key() + " " + r.http.URL.Path + " " + hex.EncodeToString(sum[:])
+}
+
+// forwardResult is the response of the upstream gateway
+type forwardResult struct {
+	status  int
+	header  http.Header
+	body    []byte
+	latency time.Duration
+}
+
+// deliveryIDs returns the identifiers of the delivery by the upstream
+// gateway, for correlating forwarded pushes like local ones: the apns-id
+// header, and the ids of a success body like the one of RCPG_SUCCESS_BODY
+func (res *forwardResult) deliveryIDs() (apnsID, messageID string) {
+	var body successResponse
+	json.Unmarshal(res.body, &body)
+	apnsID = res.header.Get("apns-id")
+	if apnsID == "" {
+		apnsID = body.ApnsID
 	}
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+	return apnsID, body.MessageID
 }
+
+// forwardGroup coordinates concurrent forwards of the same client with
+// RCPG_FORWARD_SINGLEFLIGHT
+var forwardGroup singleflight.Group
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+)
+
+// outboundProxy selects the proxy for connections to APNs, FCM and the
+// upstream gateway. It's RCPG_OUTBOUND_PROXY if set, and HTTPS_PROXY and
+// NO_PROXY of the environment otherwise.
+var outboundProxy = http.ProxyFromEnvironment
+
+// parseOutboundProxy parses RCPG_OUTBOUND_PROXY, empty returns nil
+func parseOutboundProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid RCPG_OUTBOUND_PROXY %q: must be a URL like http://proxy:3128", s)
+	}
+	return u, nil
+}
+
+// setupOutboundProxy sets up the outbound proxy u, nil keeps the proxy of the
+// environment. The FCM client and the forward client use the default
+// transport, so it's configured there.
+func setupOutboundProxy(u *url.URL) {
+	if u != nil {
+		outboundProxy = http.ProxyURL(u)
+	}
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.Proxy = outboundProxy
+	}
+}
+
+// usesProxy reports whether connections to the URL go through a proxy
+func usesProxy(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	proxy, err := outboundProxy(&http.Request{URL: u})
+	return err == nil && proxy != nil
+}
+
+// newAPNSProxyTransport returns an HTTP/2 transport for APNs that connects
+// through the outbound proxy, which the transport of apns2 doesn't support
+func newAPNSProxyTransport(tlsConfig *tls.Config) http.RoundTripper {
+	t := &http.Transport{
+		Proxy:               outboundProxy,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: apns2.TLSDialTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+	if h2, err := http2.ConfigureTransports(t); err == nil {
+		h2.ReadIdleTimeout = apns2.ReadIdleTimeout
+	}
+	return t
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statsFlushInterval = time.Minute
+
+// statusRecord is the persisted form of a status
+type statusRecord struct {
+	ID                string `json:"id"`
+	IP                string `json:"ip"`
+	Host              string `json:"host"`
+	FCM               uint64 `json:"fcm"`
+	APN               uint64 `json:"apn"`
+	Forwarded         uint64 `json:"forwarded"`
+	ForwardSucceeded  uint64 `json:"forwardSucceeded"`
+	ForwardFailed     uint64 `json:"forwardFailed"`
+	ForwardSkipped    uint64 `json:"forwardSkipped"`
+	Duplicates        uint64 `json:"duplicates"`
+	AsyncFailed       uint64 `json:"asyncFailed"`
+	InvalidTokens     uint64 `json:"invalidTokens"`
+	TypeMessage       uint64 `json:"typeMessage"`
+	TypeMessageIDOnly uint64 `json:"typeMessageIdOnly"`
+	TypeOther         uint64 `json:"typeOther"`
+	APNSAuthErrors    uint64 `json:"apnsAuthErrors"`
+	APNSPayloadErrors uint64 `json:"apnsPayloadErrors"`
+	APNSRateErrors    uint64 `json:"apnsRateErrors"`
+	APNSServerErrors  uint64 `json:"apnsServerErrors"`
+	// ForceFilter is only read from stats files of older versions, the rules
+	// are saved in their own file now
+	ForceFilter   bool       `json:"forceFilter,omitempty"`
+	DisabledUntil *time.Time `json:"disabledUntil,omitempty"`
+}
+
+// loadStats restores the stats from file. A missing or corrupt file is
+// logged and ignored, so the gateway starts with fresh stats.
+func loadStats(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read stats file: %v", err)
+		}
+		return
+	}
+	var records []statusRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		log.Printf("Ignoring corrupt stats file: %v", err)
+		return
+	}
+	for _, rec := range records {
+		s := getStats(rec.ID, rec.IP, rec.Host)
+		s.fcm.Store(uintptr(rec.FCM))
+		s.apn.Store(uintptr(rec.APN))
+		s.forwardAttempted.Store(uintptr(rec.Forwarded))
+		s.forwardSucceeded.Store(uintptr(rec.ForwardSucceeded))
+		s.forwardFailed.Store(uintptr(rec.ForwardFailed))
+		s.forwardSkipped.Store(uintptr(rec.ForwardSkipped))
+		s.duplicates.Store(uintptr(rec.Duplicates))
+		s.asyncFailed.Store(uintptr(rec.AsyncFailed))
+		s.invalidTokens.Store(uintptr(rec.InvalidTokens))
+		s.typeMessage.Store(uintptr(rec.TypeMessage))
+		s.typeMessageIDOnly.Store(uintptr(rec.TypeMessageIDOnly))
+		s.typeOther.Store(uintptr(rec.TypeOther))
+		s.apnsAuthErrors.Store(uintptr(rec.APNSAuthErrors))
+		s.apnsPayloadErrors.Store(uintptr(rec.APNSPayloadErrors))
+		s.apnsRateErrors.Store(uintptr(rec.APNSRateErrors))
+		s.apnsServerErrors.Store(uintptr(rec.APNSServerErrors))
+		if rec.ForceFilter {
+			forceFilters.set(filterRule{rec.ID, rec.IP, rec.Host}, true)
+		}
+		if rec.DisabledUntil != nil && time.Now().Before(*rec.DisabledUntil) {
+			s.disabledUntil.Store(rec.DisabledUntil)
+		}
+	}
+	log.Printf("Loaded %d stats entries from %s", len(records), file)
+}
+
+// saveStats writes the stats to file, replacing it atomically, and returns the
+// number of saved entries
+func saveStats(file string) (int, error) {
+	records := []statusRecord{}
+	stats.Range(func(_, v any) bool {
+		s := v.(*status)
+		records = append(records, statusRecord{
+			ID:                s.id,
+			IP:                s.ip,
+			Host:              s.host,
+			FCM:               uint64(s.fcm.Load()),
+			APN:               uint64(s.apn.Load()),
+			Forwarded:         uint64(s.forwardAttempted.Load()),
+			ForwardSucceeded:  uint64(s.forwardSucceeded.Load()),
+			ForwardFailed:     uint64(s.forwardFailed.Load()),
+			ForwardSkipped:    uint64(s.forwardSkipped.Load()),
+			Duplicates:        uint64(s.duplicates.Load()),
+			AsyncFailed:       uint64(s.asyncFailed.Load()),
+			InvalidTokens:     uint64(s.invalidTokens.Load()),
+			TypeMessage:       uint64(s.typeMessage.Load()),
+			TypeMessageIDOnly: uint64(s.typeMessageIDOnly.Load()),
+			TypeOther:         uint64(s.typeOther.Load()),
+			APNSAuthErrors:    uint64(s.apnsAuthErrors.Load()),
+			APNSPayloadErrors: uint64(s.apnsPayloadErrors.Load()),
+			APNSRateErrors:    uint64(s.apnsRateErrors.Load()),
+			APNSServerErrors:  uint64(s.apnsServerErrors.Load()),
+			DisabledUntil:     s.disabledUntil.Load(),
+		})
+		return true
+	})
+	data, err := json.Marshal(records)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(file, data); err != nil {
+		return 0, err
+	}
+	if err := saveForceFilters(forceFilterFile(file)); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// writeFileAtomic replaces file with data, so it's never written partially
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// flushStats periodically saves the stats to file
+func flushStats(file string) {
+	for range time.Tick(statsFlushInterval) {
+		if _, err := saveStats(file); err != nil {
+			log.Printf("Failed to save stats: %v", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+const defaultMaxQueue = 100
+
+// sendPool bounds the number of concurrent backend sends. Sends beyond the
+// limit wait for a free slot, up to maxQueue of them, further ones are
+// rejected.
+type sendPool struct {
+	slots    chan struct{}
+	waiting  atomic.Int64
+	maxQueue int64
+}
+
+// newSendPool creates the pool of size concurrent sends, with up to maxQueue
+// waiting ones
+func newSendPool(size, maxQueue int) *sendPool {
+	return &sendPool{
+		slots:    make(chan struct{}, size),
+		maxQueue: int64(maxQueue),
+	}
+}
+
+var errQueueFull = errors.New("too many concurrent notifications")
+
+// acquire waits for a free slot until ctx is done. It returns errQueueFull if
+// the queue is full, or the error of ctx.
+func (p *sendPool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if p.waiting.Add(1) > p.maxQueue {
+		p.waiting.Add(-1)
+		return errQueueFull
+	}
+	defer p.waiting.Add(-1)
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *sendPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.slots
+}
+
+// acquireSend acquires a slot of the pool for a send of r with ctx, and
+// writes the error response if that fails
+func (r *rcRequest) acquireSend(ctx context.Context, w http.ResponseWriter, pool *sendPool) bool {
+	if err := pool.acquire(ctx); err != nil {
+		r.writeWaitError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeWaitError writes the response for a send that couldn't wait for its
+// turn, because the queue is full or ctx is done
+func (r *rcRequest) writeWaitError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQueueFull):
+		r.Printf("Send queue is full")
+		writeError(w, http.StatusServiceUnavailable, "QueueFull", err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		r.Printf("Timed out waiting to send")
+		writeError(w, http.StatusGatewayTimeout, "QueueTimeout", "timed out waiting to send")
+	default:
+		r.Printf("Stopped waiting to send: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "QueueTimeout", err.Error())
+	}
+}
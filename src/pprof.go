@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerPprof serves the runtime profiles on /debug/pprof/, protected like
+// the stats page
+func registerPprof(cfg *Config, mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", withStatsAuth(cfg, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", withStatsAuth(cfg, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", withStatsAuth(cfg, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", withStatsAuth(cfg, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", withStatsAuth(cfg, pprof.Trace))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the networks from which X-Forwarded-For is honored, set
+// by main. If RCPG_TRUSTED_PROXIES is unset, X-Forwarded-For is always
+// trusted.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses the comma separated list of CIDRs or IPs of
+// RCPG_TRUSTED_PROXIES
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var trustedProxies []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RCPG_TRUSTED_PROXIES: %w", err)
+			}
+			trustedProxies = append(trustedProxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RCPG_TRUSTED_PROXIES: %w", err)
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+	return trustedProxies, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIP returns the client IP of the request. With trusted proxies
+// configured, X-Forwarded-For is only honored if the peer is a trusted proxy,
+// and the rightmost untrusted hop is the client.
+func getIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	fwdHdr := r.Header["X-Forwarded-For"]
+	if len(fwdHdr) == 0 {
+		return peer
+	}
+	if trustedProxies == nil {
+		return strings.TrimSpace(strings.Split(fwdHdr[0], ",")[0])
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(fwdHdr, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return strings.TrimSpace(hops[0])
+}
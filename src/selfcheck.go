@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+const startupCheckTimeout = 30 * time.Second
+
+var (
+	sentinelAPNSToken = strings.Repeat("0", apnsTokenLength)
+	sentinelFCMToken  = "rcpg-startup-check"
+)
+
+// checkAPNS sends a notification for topic to the sentinel token, which APNs
+// must reject as invalid token
+func checkAPNS(pusher apnsPusher, cfg *APNSConfig, topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	res, err := pusher.Push(ctx, &apns2.Notification{
+		DeviceToken: sentinelAPNSToken,
+		Topic:       topic,
+		Payload:     payload.NewPayload().AlertBody("startup check"),
+	})
+	if err != nil {
+		return err
+	}
+	if res.Sent() {
+		return fmt.Errorf("unexpectedly sent to the invalid token")
+	}
+	if res.Reason != apns2.ReasonBadDeviceToken && !cfg.InvalidTokenReasons[res.Reason] {
+		return fmt.Errorf("APNs rejected the notification: %d %s", res.StatusCode, res.Reason)
+	}
+	return nil
+}
+
+// checkFCM validates a notification to the sentinel token with a dry-run,
+// which FCM must reject as invalid token
+func checkFCM(client fcmSender) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	_, err := client.SendDryRun(ctx, &messaging.Message{
+		Token: sentinelFCMToken,
+		Data:  map[string]string{"message": "startup check"},
+	})
+	switch {
+	case err == nil:
+		return fmt.Errorf("unexpectedly accepted the invalid token")
+	case messaging.IsInvalidArgument(err), messaging.IsUnregistered(err):
+		return nil
+	}
+	return err
+}
+
+// reportStartupCheck logs the result of the startup check of backend, and
+// exits on failure if fatal is set
+func reportStartupCheck(backend string, err error, fatal bool) {
+	if err == nil {
+		log.Printf("Startup check of %s passed", backend)
+		return
+	}
+	if fatal {
+		log.Fatalf("Startup check of %s failed: %v", backend, err)
+	}
+	log.Printf("Startup check of %s failed: %v", backend, err)
+}
@@ -1,30 +1,118 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
-)
 
-const disabledDelay = time.Hour
+	"golang.org/x/time/rate"
+)
 
 var (
-	stats     sync.Map
-	startTime = time.Now()
+	stats          sync.Map
+	startTime      atomic.Pointer[time.Time]
+	statsEntries   atomic.Int64
+	statsEvictions atomic.Uint64
+	evictMu        sync.Mutex
 )
 
+func init() {
+	resetStartTime()
+}
+
+func resetStartTime() {
+	now := time.Now()
+	startTime.Store(&now)
+}
+
 type status struct {
-	id            string
-	ip            string
-	host          string
-	fcm           atomic.Uintptr
-	apn           atomic.Uintptr
-	forwarded     atomic.Uintptr
-	disabledUntil atomic.Pointer[time.Time]
+	id   string
+	ip   string
+	host string
+	fcm  atomic.Uintptr
+	apn  atomic.Uintptr
+	// forwardAttempted counts all forwards, of which forwardSkipped were
+	// skipped because forwarding was disabled, forwardFailed failed and
+	// forwardSucceeded were accepted by the upstream gateway
+	forwardAttempted atomic.Uintptr
+	forwardSucceeded atomic.Uintptr
+	forwardFailed    atomic.Uintptr
+	forwardSkipped   atomic.Uintptr
+	duplicates       atomic.Uintptr
+	asyncFailed      atomic.Uintptr
+	invalidTokens    atomic.Uintptr
+	// typeMessage, typeMessageIDOnly and typeOther count the notifications
+	// by the notification type they're sent with
+	typeMessage       atomic.Uintptr
+	typeMessageIDOnly atomic.Uintptr
+	typeOther         atomic.Uintptr
+	// apnsAuthErrors, apnsPayloadErrors, apnsRateErrors and apnsServerErrors
+	// count the APNs rejections other than invalid tokens by their cause
+	apnsAuthErrors    atomic.Uintptr
+	apnsPayloadErrors atomic.Uintptr
+	apnsRateErrors    atomic.Uintptr
+	apnsServerErrors  atomic.Uintptr
+	disabledUntil     atomic.Pointer[time.Time]
+	// limiter is created by the first allowClient if RCPG_RATE_LIMIT is set
+	limiter atomic.Pointer[rate.Limiter]
+	// lastSeen is the time of the last request in unix nanoseconds
+	lastSeen atomic.Int64
+}
+
+// key returns the key of the status in stats
+func (s *status) key() string {
+	return s.id + s.ip + s.host
+}
+
+// countType counts the notification type, notifications without payload
+// count as other
+func (s *status) countType(pl *RCPayload) {
+	switch {
+	case pl == nil:
+		s.typeOther.Add(1)
+	case pl.NotificationType == "message":
+		s.typeMessage.Add(1)
+	case pl.NotificationType == "message-id-only":
+		s.typeMessageIDOnly.Add(1)
+	default:
+		s.typeOther.Add(1)
+	}
+}
+
+// reset zeroes the counters, but keeps disabled forwarding, so resetting the
+// stats doesn't end the cooldown
+func (s *status) reset() {
+	for _, c := range []*atomic.Uintptr{
+		&s.fcm, &s.apn,
+		&s.forwardAttempted, &s.forwardSucceeded, &s.forwardFailed, &s.forwardSkipped,
+		&s.duplicates, &s.asyncFailed, &s.invalidTokens,
+		&s.typeMessage, &s.typeMessageIDOnly, &s.typeOther,
+		&s.apnsAuthErrors, &s.apnsPayloadErrors, &s.apnsRateErrors, &s.apnsServerErrors,
+	} {
+		c.Store(0)
+	}
+}
+
+// allowClient reports whether the client of s is within RCPG_RATE_LIMIT
+func (c *Config) allowClient(s *status) bool {
+	if c.Stats.RateLimit <= 0 {
+		return true
+	}
+	l := s.limiter.Load()
+	if l == nil {
+		s.limiter.CompareAndSwap(nil, newLimiter(c.Stats.RateLimit, c.Stats.RateBurst))
+		l = s.limiter.Load()
+	}
+	return l.Allow()
 }
 
 func (s *status) isDisabled() bool {
@@ -39,11 +127,18 @@ func (s *status) isDisabled() bool {
 	return false
 }
 
-func (s *status) disable() {
-	t := time.Now().Add(disabledDelay)
+// disable disables forwarding for the client for d
+func (s *status) disable(d time.Duration) {
+	t := time.Now().Add(d)
 	s.disabledUntil.Store(&t)
 }
 
+// enable enables forwarding again before the disabled delay is over, and reports
+// whether it was disabled
+func (s *status) enable() bool {
+	return s.disabledUntil.Swap(nil) != nil
+}
+
 func getStats(id, ip, host string) *status {
 	key := id + ip + host
 	stat, ok := stats.Load(key)
@@ -53,13 +148,294 @@ func getStats(id, ip, host string) *status {
 			ip:   ip,
 			host: host,
 		}
-		stat, _ = stats.LoadOrStore(key, &s)
+		// a new client must not be evicted right away
+		s.lastSeen.Store(time.Now().UnixNano())
+		var loaded bool
+		stat, loaded = stats.LoadOrStore(key, &s)
+		if !loaded {
+			statsEntries.Add(1)
+		}
+	}
+	st := stat.(*status)
+	st.lastSeen.Store(time.Now().UnixNano())
+	return st
+}
+
+// limitStats evicts clients if more than max are tracked, 0 means unlimited
+func limitStats(max int) {
+	if max > 0 && statsEntries.Load() > int64(max) {
+		evictStats(max)
+	}
+}
+
+// deleteStats removes the stats of a client
+func deleteStats(key any) {
+	if _, loaded := stats.LoadAndDelete(key); loaded {
+		statsEntries.Add(-1)
+	}
+}
+
+// evictStats removes the least recently seen clients above max, plus 1% more
+// so that not every new client causes an eviction. Clients with disabled
+// forwarding are kept, so they can't escape the cooldown.
+func evictStats(max int) {
+	// one eviction at a time is enough
+	if !evictMu.TryLock() {
+		return
+	}
+	defer evictMu.Unlock()
+	type candidate struct {
+		key      any
+		lastSeen int64
+	}
+	var candidates []candidate
+	stats.Range(func(k, v any) bool {
+		s := v.(*status)
+		if !s.isDisabled() {
+			candidates = append(candidates, candidate{k, s.lastSeen.Load()})
+		}
+		return true
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastSeen < candidates[j].lastSeen
+	})
+	n := int(statsEntries.Load()) - max + max/100
+	for i := 0; i < n && i < len(candidates); i++ {
+		deleteStats(candidates[i].key)
+		statsEvictions.Add(1)
+	}
+}
+
+// upstreamStats records the round-trip times and response status codes of
+// the upstream gateway
+type upstreamStats struct {
+	mu       sync.Mutex
+	count    uint64
+	total    time.Duration
+	min, max time.Duration
+	statuses map[int]uint64
+}
+
+var upstream = &upstreamStats{statuses: map[int]uint64{}}
+
+func (u *upstreamStats) record(status int, latency time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == 0 || latency < u.min {
+		u.min = latency
+	}
+	if latency > u.max {
+		u.max = latency
+	}
+	u.count++
+	u.total += latency
+	u.statuses[status]++
+}
+
+func (u *upstreamStats) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.count, u.total, u.min, u.max = 0, 0, 0, 0
+	u.statuses = map[int]uint64{}
+}
+
+// html renders the upstream stats for the stats page
+func (u *upstreamStats) html() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == 0 {
+		return "<p>Upstream: no responses</p>"
+	}
+	avg := u.total / time.Duration(u.count)
+	out := fmt.Sprintf("<p>Upstream latency: min %s, avg %s, max %s</p>",
+		u.min.Round(time.Millisecond), avg.Round(time.Millisecond), u.max.Round(time.Millisecond))
+	codes := make([]int, 0, len(u.statuses))
+	for code := range u.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	out += "<table><thead><tr><th>upstream status</th><th>responses</th></tr></thead><tbody>\n"
+	for _, code := range codes {
+		out += fmt.Sprintf("<tr><td>%d</td><td>%d</td></tr>\n", code, u.statuses[code])
+	}
+	out += "</tbody></table>"
+	return out
+}
+
+// withStatsAuth protects handler with basic auth, if RCPG_STATS_USER or
+// RCPG_STATS_PASS is set
+func withStatsAuth(cfg *Config, handler http.HandlerFunc) http.HandlerFunc {
+	statsUser, statsPass := cfg.Stats.User, cfg.Stats.Pass
+	if statsUser == "" && statsPass == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// evaluate both, so the timing doesn't reveal which one is wrong
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(statsUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(statsPass)) == 1
+		if !ok || !userOK || !passOK {
+			log.Printf("Unauthorized stats request from %s", getIP(r))
+			w.Header().Set("WWW-Authenticate", `Basic realm="stats", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid credentials")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// statsRow is a snapshot of the status of a client
+type statsRow struct {
+	id, ip, host      string
+	apn               uintptr
+	fcm               uintptr
+	forwardAttempted  uintptr
+	forwardSucceeded  uintptr
+	forwardFailed     uintptr
+	forwardSkipped    uintptr
+	duplicates        uintptr
+	asyncFailed       uintptr
+	invalidTokens     uintptr
+	typeMessage       uintptr
+	typeMessageIDOnly uintptr
+	typeOther         uintptr
+	apnsAuthErrors    uintptr
+	apnsPayloadErrors uintptr
+	apnsRateErrors    uintptr
+	apnsServerErrors  uintptr
+	disabled          bool
+	disabledUntil     time.Time
+}
+
+func (s *status) snapshot() *statsRow {
+	t := s.disabledUntil.Load()
+	row := &statsRow{
+		id:                s.id,
+		ip:                s.ip,
+		host:              s.host,
+		apn:               s.apn.Load(),
+		fcm:               s.fcm.Load(),
+		forwardAttempted:  s.forwardAttempted.Load(),
+		forwardSucceeded:  s.forwardSucceeded.Load(),
+		forwardFailed:     s.forwardFailed.Load(),
+		forwardSkipped:    s.forwardSkipped.Load(),
+		duplicates:        s.duplicates.Load(),
+		asyncFailed:       s.asyncFailed.Load(),
+		invalidTokens:     s.invalidTokens.Load(),
+		typeMessage:       s.typeMessage.Load(),
+		typeMessageIDOnly: s.typeMessageIDOnly.Load(),
+		typeOther:         s.typeOther.Load(),
+		apnsAuthErrors:    s.apnsAuthErrors.Load(),
+		apnsPayloadErrors: s.apnsPayloadErrors.Load(),
+		apnsRateErrors:    s.apnsRateErrors.Load(),
+		apnsServerErrors:  s.apnsServerErrors.Load(),
+		disabled:          t != nil && time.Now().Before(*t),
+	}
+	if row.disabled {
+		row.disabledUntil = *t
+	}
+	return row
+}
+
+// direct returns the number of notifications that were sent to APNs or FCM
+// by this gateway. Forwards are counted as apn or fcm as well, and neither the
+// relayed nor the skipped ones were sent here.
+func (r *statsRow) direct() uintptr {
+	if r.forwardAttempted > r.apn+r.fcm {
+		return 0
+	}
+	return r.apn + r.fcm - r.forwardAttempted
+}
+
+type statsColumn struct {
+	name  string
+	key   string
+	value func(*statsRow) uintptr
+}
+
+// statsColumns are the counter columns of the stats table, key is used for
+// sorting with the sort query parameter
+var statsColumns = []statsColumn{
+	{"direct", "direct", (*statsRow).direct},
+	{"apn", "apn", func(r *statsRow) uintptr { return r.apn }},
+	{"fcm", "fcm", func(r *statsRow) uintptr { return r.fcm }},
+	{"forwards", "forwards", func(r *statsRow) uintptr { return r.forwardAttempted }},
+	{"succeeded forwards", "forwardSucceeded", func(r *statsRow) uintptr { return r.forwardSucceeded }},
+	{"failed forwards", "forwardFailed", func(r *statsRow) uintptr { return r.forwardFailed }},
+	{"skipped forwards", "forwardSkipped", func(r *statsRow) uintptr { return r.forwardSkipped }},
+	{"duplicates", "duplicates", func(r *statsRow) uintptr { return r.duplicates }},
+	{"failed async", "asyncFailed", func(r *statsRow) uintptr { return r.asyncFailed }},
+	{"invalid tokens", "invalidTokens", func(r *statsRow) uintptr { return r.invalidTokens }},
+	{"message", "typeMessage", func(r *statsRow) uintptr { return r.typeMessage }},
+	{"message-id-only", "typeMessageIDOnly", func(r *statsRow) uintptr { return r.typeMessageIDOnly }},
+	{"other types", "typeOther", func(r *statsRow) uintptr { return r.typeOther }},
+	{"APNs auth errors", "apnsAuthErrors", func(r *statsRow) uintptr { return r.apnsAuthErrors }},
+	{"APNs payload errors", "apnsPayloadErrors", func(r *statsRow) uintptr { return r.apnsPayloadErrors }},
+	{"APNs rate errors", "apnsRateErrors", func(r *statsRow) uintptr { return r.apnsRateErrors }},
+	{"APNs server errors", "apnsServerErrors", func(r *statsRow) uintptr { return r.apnsServerErrors }},
+}
+
+// sortStats sorts the rows by the column key, ascending unless desc is set
+func sortStats(rows []*statsRow, key string, desc bool) {
+	var less func(a, b *statsRow) bool
+	switch key {
+	case "id":
+		less = func(a, b *statsRow) bool { return a.id < b.id }
+	case "ip":
+		less = func(a, b *statsRow) bool { return a.ip < b.ip }
+	case "host":
+		less = func(a, b *statsRow) bool { return a.host < b.host }
+	default:
+		for _, col := range statsColumns {
+			if col.key == key {
+				value := col.value
+				less = func(a, b *statsRow) bool { return value(a) < value(b) }
+			}
+		}
+	}
+	if less == nil {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if desc {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+}
+
+// paginate returns the rows selected by the offset and limit query
+// parameters, a limit of 0 means all rows
+func paginate(rows []*statsRow, offset, limit int) []*statsRow {
+	if offset > len(rows) {
+		offset = len(rows)
 	}
-	return stat.(*status)
+	rows = rows[offset:]
+	if limit > 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("StatsHandler for %s from %s", r.RequestURI, getIP(r))
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	onlyDisabled := q.Get("disabled") == "true"
+
+	var rows []*statsRow
+	stats.Range(func(_, v any) bool {
+		if row := v.(*status).snapshot(); row.disabled || !onlyDisabled {
+			rows = append(rows, row)
+		}
+		return true
+	})
+
 	out := `
 <!DOCTYPE html>
 <html><head>
@@ -76,20 +452,152 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 </style>
 </head><body>
 <h2>Rocket.Chat Push Gateway Stats</h2>`
-	out += fmt.Sprintf("<p>Uptime: %s</p>", time.Since(startTime).Truncate(time.Second))
-	out += `<table><thead><tr>
-<th>id</th><th>ip</th><th>host</th><th>direct</th><th>apn</th><th>fcm</th><th>forwards</th>
-</tr></thead><tbody>
-`
-	stats.Range(func(_, v any) bool {
-		stats := v.(*status)
-		apn := stats.apn.Load()
-		fcm := stats.fcm.Load()
-		forwarded := stats.forwarded.Load()
-		out += fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%d</td></tr>",
-			stats.id, stats.ip, stats.host, apn+fcm-forwarded, apn, fcm, forwarded)
+	out += fmt.Sprintf("<p>Uptime: %s</p>", time.Since(*startTime.Load()).Truncate(time.Second))
+	out += "<table><thead><tr>\n<th>id</th><th>ip</th><th>host</th>"
+	for _, col := range statsColumns {
+		out += "<th>" + col.name + "</th>"
+	}
+	out += "<th>forwarding disabled until</th>"
+	out += "\n</tr></thead><tbody>\n"
+
+	totals := make([]uintptr, len(statsColumns))
+	disabled := 0
+	for _, row := range rows {
+		for i, col := range statsColumns {
+			totals[i] += col.value(row)
+		}
+		if row.disabled {
+			disabled++
+		}
+	}
+
+	sortStats(rows, q.Get("sort"), q.Get("order") == "desc")
+	for _, row := range paginate(rows, offset, limit) {
+		out += fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td>",
+			html.EscapeString(row.id), html.EscapeString(row.ip), html.EscapeString(row.host))
+		for _, col := range statsColumns {
+			out += fmt.Sprintf("<td>%d</td>", col.value(row))
+		}
+		out += "<td>"
+		if row.disabled {
+			out += row.disabledUntil.Format(time.RFC3339)
+		}
+		out += "</td></tr>\n"
+	}
+
+	out += "</tbody><tfoot><tr><th colspan=\"3\">total</th>"
+	for _, total := range totals {
+		out += fmt.Sprintf("<th>%d</th>", total)
+	}
+	out += "<th></th>"
+	out += "</tr></tfoot></table>"
+	out += fmt.Sprintf("<p>Clients: %d, forwarding disabled: %d, evicted: %d</p>",
+		len(rows), disabled, statsEvictions.Load())
+	out += upstream.html()
+	out += "</body></html>"
+	io.WriteString(w, out)
+}
+
+// withAdmin restricts handler to authorized POST requests
+func withAdmin(cfg *Config, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "this endpoint only accepts POST requests")
+			return
+		}
+		if !cfg.isAuthorized(r) {
+			writeError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid bearer token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// withAuthToken restricts handler to requests with RCPG_AUTH_TOKEN as bearer
+// token. Without a token the endpoint doesn't exist, as it must not be public.
+func withAuthToken(cfg *Config, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AuthToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !cfg.isAuthorized(r) {
+			log.Printf("Unauthorized request for %s from %s", r.URL.Path, getIP(r))
+			writeError(w, http.StatusUnauthorized, "Unauthorized", "missing or invalid bearer token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// rangeMatching calls f for all clients matching the id, ip and host query
+// parameters, that are set. It returns the number of matches.
+func rangeMatching(q url.Values, f func(key any, s *status)) int {
+	id, ip, host := q.Get("id"), q.Get("ip"), q.Get("host")
+	n := 0
+	stats.Range(func(k, v any) bool {
+		s := v.(*status)
+		if (id == "" || id == s.id) && (ip == "" || ip == s.ip) && (host == "" || host == s.host) {
+			f(k, s)
+			n++
+		}
 		return true
 	})
-	out += "</tbody></table></body></html>"
-	io.WriteString(w, out)
+	return n
+}
+
+// statsResetHandler zeroes the counters of the clients matching the optional
+// id, ip and host query parameters, or of all clients if none are given.
+// Disabled forwarding and forced filtering stay in place.
+func statsResetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("StatsResetHandler for %s from %s", r.RequestURI, getIP(r))
+	q := r.URL.Query()
+	n := rangeMatching(q, func(_ any, s *status) {
+		s.reset()
+	})
+	if q.Get("id") == "" && q.Get("ip") == "" && q.Get("host") == "" {
+		resetStartTime()
+		upstream.reset()
+		invalidTokens.reset()
+	}
+	log.Printf("Reset %d stats entries", n)
+	fmt.Fprintf(w, "Reset %d stats entries\n", n)
+}
+
+// forceFilterHandler adds or removes the rule to force filtering, as on the
+// /filter routes, for the clients matching the id, ip and host query
+// parameters, depending on the enabled query parameter. The rule also applies
+// to clients that weren't seen yet.
+func forceFilterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ForceFilterHandler for %s from %s", r.RequestURI, getIP(r))
+	q := r.URL.Query()
+	if q.Get("id") == "" && q.Get("ip") == "" && q.Get("host") == "" {
+		writeError(w, http.StatusBadRequest, "BadRequest", "one of id, ip or host is required")
+		return
+	}
+	enabled, err := strconv.ParseBool(q.Get("enabled"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest", "enabled must be true or false")
+		return
+	}
+	forceFilters.set(filterRule{ID: q.Get("id"), IP: q.Get("ip"), Host: q.Get("host")}, enabled)
+	n := rangeMatching(q, func(_ any, _ *status) {})
+	log.Printf("Set forced filtering to %t for %d known clients", enabled, n)
+	fmt.Fprintf(w, "Set forced filtering to %t for %d known clients\n", enabled, n)
+}
+
+// enableForwardingHandler enables forwarding again for the clients matching
+// the id, ip and host query parameters, or all clients if none are given,
+// that were disabled after the upstream gateway rejected them
+func enableForwardingHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("EnableForwardingHandler for %s from %s", r.RequestURI, getIP(r))
+	enabled := 0
+	rangeMatching(r.URL.Query(), func(_ any, s *status) {
+		if s.enable() {
+			enabled++
+		}
+	})
+	log.Printf("Enabled forwarding for %d clients", enabled)
+	fmt.Fprintf(w, "Enabled forwarding for %d clients\n", enabled)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+func TestStatsRowDirect(t *testing.T) {
+	tests := []struct {
+		name string
+		row  statsRow
+		want uintptr
+	}{
+		{"no forwards", statsRow{apn: 3, fcm: 2}, 5},
+		{"relayed", statsRow{apn: 3, fcm: 2, forwardAttempted: 2, forwardSucceeded: 2}, 3},
+		{"disabled", statsRow{apn: 3, fcm: 2, forwardAttempted: 4, forwardSucceeded: 1, forwardSkipped: 3}, 1},
+		{"more forwards than sends", statsRow{apn: 1, forwardAttempted: 2}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.row.direct(); got != tt.want {
+			t.Errorf("%s: direct() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDirectWithDisabledClient(t *testing.T) {
+	var forwarded *http.Request
+	cfg := testConfig(fakeUpstream(http.StatusOK, &forwarded))
+	handler := withRCRequest(cfg, newAPNHandler(cfg, &fakePusher{res: &apns2.Response{StatusCode: 200}}), false)
+	push := func(topic string) int {
+		n := testNotification(testAPNSToken, topic)
+		n.Options.UniqueID = "direct-disabled"
+		w := httptest.NewRecorder()
+		handler(w, pushRequest("/push/apn/send", notificationBody(n)))
+		return w.Code
+	}
+	s := getStats("direct-disabled", "192.0.2.1", "https://chat.example.com")
+
+	// one notification delivered and one relayed, then two skipped while
+	// forwarding is disabled for the client
+	codes := []int{push(testTopic), push(apnsUpstreamTopic)}
+	s.disable(time.Minute)
+	codes = append(codes, push(apnsUpstreamTopic), push(apnsUpstreamTopic))
+	want := []int{http.StatusOK, http.StatusOK, http.StatusUnprocessableEntity, http.StatusUnprocessableEntity}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("status codes = %v, want %v", codes, want)
+		}
+	}
+	row := s.snapshot()
+	if row.forwardSkipped != 2 {
+		t.Errorf("skipped forwards = %d, want 2", row.forwardSkipped)
+	}
+	if got := row.direct(); got != 1 {
+		t.Errorf("direct = %d, want 1 (apn %d, forwards %d, skipped %d)",
+			got, row.apn, row.forwardAttempted, row.forwardSkipped)
+	}
+}
+
+func TestInvalidTokenLog(t *testing.T) {
+	l := &invalidTokenLog{entries: make([]invalidToken, 0, 2)}
+	for _, token := range []string{"a", "b", "c"} {
+		l.add(invalidToken{Token: token})
+	}
+	if got := l.total.Load(); got != 3 {
+		t.Errorf("total = %d, want 3", got)
+	}
+	recent := l.recent()
+	if len(recent) != 2 || recent[0].Token != "c" || recent[1].Token != "b" {
+		t.Errorf("recent = %+v, want c, b", recent)
+	}
+}
+
+func TestCountType(t *testing.T) {
+	s := &status{}
+	for _, pl := range []*RCPayload{
+		nil,
+		{NotificationType: "message"},
+		{NotificationType: "message-id-only"},
+		{NotificationType: "message-id-only"},
+		{NotificationType: "video-conference"},
+	} {
+		s.countType(pl)
+	}
+	if s.typeMessage.Load() != 1 || s.typeMessageIDOnly.Load() != 2 || s.typeOther.Load() != 2 {
+		t.Errorf("message = %d, message-id-only = %d, other = %d, want 1, 2, 2",
+			s.typeMessage.Load(), s.typeMessageIDOnly.Load(), s.typeOther.Load())
+	}
+}
+
+func TestCountTypeSkipsRateLimited(t *testing.T) {
+	t.Cleanup(func() {
+		stats.Range(func(k, _ any) bool {
+			deleteStats(k)
+			return true
+		})
+	})
+	cfg := testConfigEnv(nil, map[string]string{"RCPG_RATE_LIMIT": "1", "RCPG_RATE_BURST": "1"})
+	handler := withRCRequest(cfg, newAPNHandler(cfg, &fakePusher{res: &apns2.Response{StatusCode: 200}}), false)
+	n := testNotification(testAPNSToken, testTopic)
+	n.Options.UniqueID = "rate-limited"
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, pushRequest("/push/apn/send", notificationBody(n)))
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Fatalf("status codes = %v, want 200, 429", codes)
+	}
+	s := getStats("rate-limited", "192.0.2.1", "https://chat.example.com")
+	if n := s.typeMessage.Load(); n != 1 {
+		t.Errorf("message = %d, want 1", n)
+	}
+}
+
+func TestAllowHost(t *testing.T) {
+	cfg := &Config{HostRateLimit: 1, HostRateBurst: 2}
+	t.Cleanup(func() {
+		hostLimiters.Range(func(k, _ any) bool {
+			hostLimiters.Delete(k)
+			return true
+		})
+	})
+	for i, want := range []bool{true, true, false} {
+		if got := cfg.allowHost("https://busy.example.com"); got != want {
+			t.Errorf("request %d of the busy host allowed = %t, want %t", i, got, want)
+		}
+	}
+	// other hosts have their own budget, requests without host have none
+	if !cfg.allowHost("https://chat.example.com") || !cfg.allowHost("") {
+		t.Error("request of another host not allowed")
+	}
+	sweepHostLimiters()
+	if _, ok := hostLimiters.Load("https://busy.example.com"); !ok {
+		t.Error("limiter of the busy host was removed")
+	}
+}
+
+func TestStatsResetKeepsOverrides(t *testing.T) {
+	t.Cleanup(func() {
+		stats.Range(func(k, _ any) bool {
+			deleteStats(k)
+			return true
+		})
+		forceFilters.set(filterRule{Host: "https://chat.example.com"}, false)
+	})
+	s := getStats("id", "", "https://chat.example.com")
+	s.apn.Add(3)
+	s.disable(time.Hour)
+	forceFilterHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/stats/filter?host=https://chat.example.com&enabled=true", nil))
+	statsResetHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/stats/reset", nil))
+
+	if n := s.apn.Load(); n != 0 {
+		t.Errorf("apn = %d after reset, want 0", n)
+	}
+	if !s.isDisabled() {
+		t.Error("reset enabled forwarding")
+	}
+	if !forceFilters.matches(s) {
+		t.Error("reset removed forced filtering")
+	}
+	// the rule applies to clients of the host that weren't seen before
+	if !forceFilters.matches(getStats("new", "", "https://chat.example.com")) {
+		t.Error("forced filtering doesn't apply to a new client of the host")
+	}
+	if forceFilters.matches(getStats("other", "", "https://other.example.com")) {
+		t.Error("forced filtering applies to another host")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type testRequest struct {
+	Token string `json:"token"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// Topic is the APNs topic, the first configured topic by default
+	Topic string `json:"topic"`
+}
+
+type testResponse struct {
+	Sent   bool            `json:"sent"`
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// testSendHandler sends a canned notification to the token in the request
+// through handler, without going through Rocket.Chat, and responds with the
+// result of the backend
+func testSendHandler(cfg *Config, handler func(http.ResponseWriter, *rcRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("TestSendHandler for %s from %s", req.RequestURI, getIP(req))
+		var tr testRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, cfg.MaxBodyBytes)).Decode(&tr); err != nil {
+			writeError(w, http.StatusBadRequest, "BadRequest", "failed to parse request body: "+err.Error())
+			return
+		}
+		if tr.Token == "" {
+			writeError(w, http.StatusBadRequest, "MissingField", "missing field: token")
+			return
+		}
+		if tr.Title == "" {
+			tr.Title = "Rocket.Chat Push Gateway"
+		}
+		if tr.Body == "" {
+			tr.Body = "This is a test notification"
+		}
+
+		r := &rcRequest{
+			id:        uint(reqID.Add(1)),
+			requestID: getRequestID(req),
+			ip:        getIP(req),
+			http:      req,
+			ejson:     []byte("{}"),
+		}
+		r.data.Token = tr.Token
+		r.data.Options.Title = tr.Title
+		r.data.Options.Text = tr.Body
+		r.data.Options.Topic = tr.Topic
+		if topics := cfg.APNS.topics(); tr.Topic == "" && len(topics) > 0 {
+			r.data.Options.Topic = topics[0]
+		}
+		r.data.Options.UniqueID = "test"
+		r.stats = getStats(r.data.Options.UniqueID, r.ip, r.host)
+		w.Header().Set("X-Request-ID", r.requestID)
+		r.Printf("Sending test notification")
+
+		rec := &resultWriter{header: http.Header{}}
+		handler(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		resp := testResponse{
+			Sent:   rec.status < 300,
+			Status: rec.status,
+		}
+		if json.Valid(rec.body) {
+			resp.Result = rec.body
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
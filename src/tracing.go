@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the gateway. It's a no-op unless
+// RCPG_OTEL_ENDPOINT is set.
+var tracer = otel.Tracer("github.com/ansiwen/rocketchat-push-gateway")
+
+// tracerProvider exports the spans, nil if tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+// parseOTelEndpoint parses RCPG_OTEL_ENDPOINT, empty returns nil
+func parseOTelEndpoint(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid RCPG_OTEL_ENDPOINT %q: must be a URL like http://collector:4318", s)
+	}
+	return u, nil
+}
+
+// setupTracing sets up the export of spans with OTLP over HTTP to u, and the
+// propagation of the W3C trace context. Nil u disables tracing.
+func setupTracing(u *url.URL) error {
+	if u == nil {
+		return nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("creating the OTLP exporter for RCPG_OTEL_ENDPOINT: %w", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("rocketchat-push-gateway"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Printf("Exporting traces to %s", u)
+	return nil
+}
+
+// shutdownTracing exports the remaining spans
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("Failed to export traces: %v", err)
+	}
+}
+
+// startRequestSpan starts the span of a push request, as child of the trace
+// context in its headers
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// endRequestSpan records the outcome of the request on its span and ends it
+func endRequestSpan(span trace.Span, r *rcRequest, status int) {
+	span.SetAttributes(
+		attribute.String("rcpg.backend", r.backend),
+		semconv.HTTPStatusCode(status),
+		attribute.Bool("rcpg.token_deleted", r.tokenDeleted),
+	)
+	if r.host != "" {
+		span.SetAttributes(attribute.String("rcpg.host", r.host))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startBackendSpan starts the span of a call to backend
+func startBackendSpan(ctx context.Context, name, backend string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rcpg.backend", backend)))
+}
+
+// endSpan records err and attrs on span and ends it
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext adds the trace context of ctx to the headers of a
+// request to another service
+func injectTraceContext(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type versionInfo struct {
+	Version      string            `json:"version"`
+	Commit       string            `json:"commit,omitempty"`
+	BuildDate    string            `json:"buildDate,omitempty"`
+	GoVersion    string            `json:"goVersion"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+func getVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Commit == "" {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Commit = s.Value
+			}
+		}
+	}
+	info.Dependencies = make(map[string]string)
+	for _, dep := range bi.Deps {
+		switch dep.Path {
+		case "github.com/sideshow/apns2", "firebase.google.com/go/v4":
+			info.Dependencies[dep.Path] = dep.Version
+		}
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("VersionHandler for %s from %s", r.RequestURI, getIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getVersionInfo())
+}
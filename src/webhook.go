@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	webhookQueue   = 1000
+	webhookTimeout = 10 * time.Second
+)
+
+// resultWebhook posts the final result of every push to RCPG_RESULT_WEBHOOK,
+// so external systems can track the delivery. Posting happens in the
+// background and failures only get logged, at most once per minute.
+type resultWebhook struct {
+	url      string
+	client   *http.Client
+	queue    chan webhookResult
+	logLimit *rate.Limiter
+	pending  pendingWork
+}
+
+type webhookResult struct {
+	RequestID string `json:"requestId"`
+	Backend   string `json:"backend,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Host      string `json:"host,omitempty"`
+	UniqueID  string `json:"uniqueId,omitempty"`
+	Status    int    `json:"status"`
+	Result    string `json:"result"`
+}
+
+// newResultWebhook starts the worker that posts the results to url
+func newResultWebhook(url string) *resultWebhook {
+	h := &resultWebhook{
+		url:      url,
+		client:   &http.Client{Timeout: webhookTimeout},
+		queue:    make(chan webhookResult, webhookQueue),
+		logLimit: rate.NewLimiter(rate.Every(time.Minute), 1),
+	}
+	go h.worker()
+	return h
+}
+
+// notify queues the result of r with the final status for the webhook
+func (h *resultWebhook) notify(r *rcRequest, status int) {
+	if h == nil {
+		return
+	}
+	res := webhookResult{
+		RequestID: r.requestID,
+		Backend:   r.backend,
+		Host:      r.host,
+		UniqueID:  r.data.Options.UniqueID,
+		Status:    status,
+	}
+	if r.data.Token != "" {
+		res.Token = redactToken(r.data.Token)
+	}
+	switch {
+	case status < 300:
+		res.Result = "success"
+	case r.tokenDeleted:
+		res.Result = "token-deleted"
+	default:
+		res.Result = "failed"
+	}
+	h.pending.add()
+	select {
+	case h.queue <- res:
+	default:
+		h.pending.done()
+		h.logf("Result webhook queue is full, dropping result")
+	}
+}
+
+func (h *resultWebhook) worker() {
+	for res := range h.queue {
+		h.post(res)
+		h.pending.done()
+	}
+}
+
+// post posts a result to the webhook
+func (h *resultWebhook) post(res webhookResult) {
+	body, _ := json.Marshal(res)
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.logf("Failed to post result to webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		h.logf("Result webhook responded with %s", resp.Status)
+	}
+}
+
+// logf logs webhook problems, but at most once per minute, so an unreachable
+// webhook doesn't flood the log
+func (h *resultWebhook) logf(s string, v ...any) {
+	if h.logLimit.Allow() {
+		log.Printf(s, v...)
+	}
+}